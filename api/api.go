@@ -1,9 +1,14 @@
 package api
 
 import (
+	"fmt"
+	"io"
+	"strconv"
 	"strings"
+	"time"
 	"tongs/global"
 	"tongs/model"
+	"tongs/tong"
 
 	"github.com/gin-gonic/gin"
 )
@@ -15,28 +20,41 @@ func GetTongs(c *gin.Context) {
 func RunTongs(c *gin.Context) {
 	var param model.Param
 	c.BindJSON(&param)
-	t, err := global.TongsManager.FindTongs(param.Tongs)
+	err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandRun, Tongs: param.Tongs, Urls: strings.Split(param.Url, ",")})
 	if err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
-	err = t.Run(strings.Split(param.Url, ",")...)
-	if err != nil {
+	model.Ok(c)
+}
+
+func StopTongs(c *gin.Context) {
+	var param model.Param
+	c.BindJSON(&param)
+	if err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandStop, Tongs: param.Tongs}); err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
 	model.Ok(c)
 }
 
-func StopTongs(c *gin.Context) {
+func ResetTongs(c *gin.Context) {
 	var param model.Param
 	c.BindJSON(&param)
+	opt, err := tong.ParseResetOption(param.Reset)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
 	t, err := global.TongsManager.FindTongs(param.Tongs)
 	if err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
-	t.Stop()
+	if err = t.Reset(opt); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
 	model.Ok(c)
 }
 
@@ -55,29 +73,41 @@ func RunTask(c *gin.Context) {
 	var param model.Param
 	c.BindJSON(&param)
 
-	t, err := global.TongsManager.FindTongs(param.Tongs)
-	if err != nil {
+	if err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandRun, Tongs: param.Tongs, Task: param.Task, Urls: []string{param.Url}}); err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
-	err = t.RunTask(param.Task, param.Url)
-	if err != nil {
+	model.Ok(c)
+}
+
+func StopTask(c *gin.Context) {
+	var param model.Param
+	c.BindJSON(&param)
+
+	if err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandStop, Tongs: param.Tongs, Task: param.Task}); err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
 	model.Ok(c)
 }
 
-func StopTask(c *gin.Context) {
+func ResetTask(c *gin.Context) {
 	var param model.Param
 	c.BindJSON(&param)
-
+	opt, err := tong.ParseResetOption(param.Reset)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
 	t, err := global.TongsManager.FindTongs(param.Tongs)
 	if err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
-	t.StopTask(param.Task)
+	if err = t.ResetTask(param.Task, opt); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
 	model.Ok(c)
 }
 
@@ -90,10 +120,461 @@ func AddUrl(c *gin.Context) {
 		model.Error(-1, err.Error(), c)
 		return
 	}
-	err = t.AddURL(param.Url)
+	if param.Delay > 0 {
+		err = t.AddURLAfter(param.Url, time.Duration(param.Delay)*time.Second)
+	} else if param.Priority != 0 {
+		err = t.AddURLWithPriority(param.Url, param.Priority)
+	} else {
+		err = t.AddURL(param.Url)
+	}
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+// GetQueue 获取队列长度,未指定任务时返回Tongs内所有队列任务
+func GetQueue(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.Query("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	if c.Query("task") == "" {
+		stats, err := t.QueueStats()
+		if err != nil {
+			model.Error(-1, err.Error(), c)
+			return
+		}
+		model.OkWithData(stats, c)
+		return
+	}
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	stat, err := task.QueueStat()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(stat, c)
+}
+
+func PeekQueue(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	entries, err := task.PeekQueue(offset, limit)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(entries, c)
+}
+
+func SearchQueue(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	entries, err := task.SearchQueue(c.Query("keyword"), limit)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(entries, c)
+}
+
+func RemoveQueued(c *gin.Context) {
+	var param model.QueueParam
+	c.BindJSON(&param)
+	task, err := global.TongsManager.FindTask(param.Tongs, param.Task)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	n, err := task.RemoveQueued(param.Urls...)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(n, c)
+}
+
+func MoveQueued(c *gin.Context) {
+	var param model.QueueParam
+	c.BindJSON(&param)
+	task, err := global.TongsManager.FindTask(param.Tongs, param.Task)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	if param.ToTongs == "" {
+		param.ToTongs = param.Tongs
+	}
+	to, err := global.TongsManager.FindTask(param.ToTongs, param.ToTask)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	n, err := task.MoveQueued(to, param.Urls...)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(n, c)
+}
+
+func GetDeadLetters(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	letters, total, err := task.DeadLetters(offset, limit)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(gin.H{"total": total, "list": letters}, c)
+}
+
+func ReplayDeadLetters(c *gin.Context) {
+	var param model.DeadLetterParam
+	c.BindJSON(&param)
+	task, err := global.TongsManager.FindTask(param.Tongs, param.Task)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	n, err := task.ReplayDeadLetters(param.Ids...)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(n, c)
+}
+
+func PurgeDeadLetters(c *gin.Context) {
+	var param model.DeadLetterParam
+	c.BindJSON(&param)
+	task, err := global.TongsManager.FindTask(param.Tongs, param.Task)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	n, err := task.PurgeDeadLetters()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(n, c)
+}
+
+func GetIdentities(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.Query("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	identities, err := t.Identities()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(identities, c)
+}
+
+func ImportIdentity(c *gin.Context) {
+	var param model.IdentityParam
+	c.BindJSON(&param)
+	t, err := global.TongsManager.FindTongs(param.Tongs)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	if err = t.ImportIdentity(param.Name, param.Cookies); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func RetireIdentity(c *gin.Context) {
+	var param model.IdentityParam
+	c.BindJSON(&param)
+	t, err := global.TongsManager.FindTongs(param.Tongs)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	if err = t.RetireIdentity(param.Name, param.Reason); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func RemoveIdentity(c *gin.Context) {
+	var param model.IdentityParam
+	c.BindJSON(&param)
+	t, err := global.TongsManager.FindTongs(param.Tongs)
 	if err != nil {
 		model.Error(-1, err.Error(), c)
 		return
 	}
+	if err = t.RemoveIdentity(param.Name); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
 	model.Ok(c)
 }
+
+func ExportTongs(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.Query("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	exportFrontier(c, t.Name, t.Export)
+}
+
+func ImportTongs(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.PostForm("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	importFrontier(c, t.Import)
+}
+
+func ExportTask(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	exportFrontier(c, c.Query("tongs")+"-"+task.Name, task.Export)
+}
+
+func ImportTask(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.PostForm("tongs"), c.PostForm("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	importFrontier(c, task.Import)
+}
+
+// frontierScope 导出导入的内容,默认全部
+func frontierScope(scope string) (tong.ResetOption, error) {
+	if scope == "" {
+		return tong.ResetAll, nil
+	}
+	return tong.ParseResetOption(scope)
+}
+
+// exportFrontier 直接写入响应,已经开始写入后出错只能中断下载
+func exportFrontier(c *gin.Context, name string, export func(w io.Writer, opt tong.ResetOption) error) {
+	opt, err := frontierScope(c.Query("scope"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s.jsonl.gz", name, time.Now().Format("20060102150405")))
+	if err := export(c.Writer, opt); err != nil {
+		if !c.Writer.Written() {
+			c.Header("Content-Type", "")
+			c.Header("Content-Disposition", "")
+			model.Error(-1, err.Error(), c)
+			return
+		}
+		c.Abort()
+	}
+}
+
+func importFrontier(c *gin.Context, load func(r io.Reader, opt tong.ResetOption) (int, error)) {
+	opt, err := frontierScope(c.PostForm("scope"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	file, err := c.FormFile("file")
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	f, err := file.Open()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	defer f.Close()
+	n, err := load(f, opt)
+	if err != nil {
+		model.Error(-1, fmt.Sprintf("已导入%d条记录, %s", n, err.Error()), c)
+		return
+	}
+	model.OkWithData(n, c)
+}
+
+func GetKeys(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.Query("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	keys, err := t.Keys()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(keys, c)
+}
+
+func GetSchedules(c *gin.Context) {
+	model.OkWithData(global.TongsManager.Schedules(c.Query("tongs")), c)
+}
+
+func SetSchedule(c *gin.Context) {
+	var param model.ScheduleParam
+	c.BindJSON(&param)
+	if err := global.TongsManager.SetSchedule(param.Tongs, param.Task, param.Cron, param.Overlap); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func EnableSchedule(c *gin.Context) {
+	enableSchedule(c, true)
+}
+
+func DisableSchedule(c *gin.Context) {
+	enableSchedule(c, false)
+}
+
+func enableSchedule(c *gin.Context, enabled bool) {
+	var param model.ScheduleParam
+	c.BindJSON(&param)
+	if err := global.TongsManager.EnableSchedule(param.Tongs, param.Task, enabled); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func RemoveSchedule(c *gin.Context) {
+	var param model.ScheduleParam
+	c.BindJSON(&param)
+	if err := global.TongsManager.RemoveSchedule(param.Tongs, param.Task); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func GetGraph(c *gin.Context) {
+	t, err := global.TongsManager.FindTongs(c.Query("tongs"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(t.Graph(), c)
+}
+
+func GetHistory(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	runs, total, err := task.History(offset, limit)
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(gin.H{"total": total, "list": runs, "current": task.LastRun()}, c)
+}
+
+func GetHistoryRun(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	id, err := strconv.ParseUint(c.Query("id"), 10, 64)
+	if err != nil {
+		model.Error(-1, "运行记录id错误", c)
+		return
+	}
+	run, err := task.HistoryRun(uint(id))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(run, c)
+}
+
+func PauseTask(c *gin.Context) {
+	var param model.Param
+	c.BindJSON(&param)
+
+	if err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandPause, Tongs: param.Tongs, Task: param.Task}); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func ResumeTask(c *gin.Context) {
+	var param model.Param
+	c.BindJSON(&param)
+
+	if err := global.TongsManager.Exec(&tong.Command{Action: tong.CommandResume, Tongs: param.Tongs, Task: param.Task}); err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.Ok(c)
+}
+
+func GetTransitions(c *gin.Context) {
+	task, err := global.TongsManager.FindTask(c.Query("tongs"), c.Query("task"))
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(gin.H{"status": task.State(), "list": task.Transitions()}, c)
+}
+
+func GetWorkers(c *gin.Context) {
+	workers, err := global.TongsManager.Workers()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(gin.H{"current": global.TongsManager.WorkerID(), "list": workers}, c)
+}
+
+func GetLeader(c *gin.Context) {
+	leader, err := global.TongsManager.Leader()
+	if err != nil {
+		model.Error(-1, err.Error(), c)
+		return
+	}
+	model.OkWithData(leader, c)
+}
@@ -1,7 +1,22 @@
 package config
 
 type Redis struct {
-	Addr     string `json:"addr" yaml:"addr" mapstructure:"addr"`
-	Password string `json:"password" yaml:"password" mapstructure:"password"`
-	MaxIdl   int    `json:"max-idl" yaml:"max-idl" mapstructure:"max-idl"`
+	Mode          string   `json:"mode,omitempty" yaml:"mode" mapstructure:"mode"`                                  //部署模式 single: 默认 单节点 sentinel: 哨兵 cluster: 集群
+	Addr          string   `json:"addr" yaml:"addr" mapstructure:"addr"`                                            //单节点地址
+	Addrs         []string `json:"addrs,omitempty" yaml:"addrs" mapstructure:"addrs"`                               //哨兵或集群节点地址 为空时使用addr
+	MasterName    string   `json:"master-name,omitempty" yaml:"master-name" mapstructure:"master-name"`             //哨兵模式的主节点名称
+	Password      string   `json:"password" yaml:"password" mapstructure:"password"`                                //密码
+	DB            int      `json:"db,omitempty" yaml:"db" mapstructure:"db"`                                        //数据库序号 集群模式只能使用0
+	MaxIdl        int      `json:"max-idl" yaml:"max-idl" mapstructure:"max-idl"`                                   //最小空闲连接数
+	PoolSize      int      `json:"pool-size,omitempty" yaml:"pool-size" mapstructure:"pool-size"`                   //连接池大小 默认为CPU数量*10
+	DialTimeout   int      `json:"dial-timeout,omitempty" yaml:"dial-timeout" mapstructure:"dial-timeout"`          //连接超时时间,单位毫秒 默认5000
+	ReadTimeout   int      `json:"read-timeout,omitempty" yaml:"read-timeout" mapstructure:"read-timeout"`          //读超时时间,单位毫秒 默认3000
+	WriteTimeout  int      `json:"write-timeout,omitempty" yaml:"write-timeout" mapstructure:"write-timeout"`       //写超时时间,单位毫秒 默认与读超时相同
+	TLS           bool     `json:"tls,omitempty" yaml:"tls" mapstructure:"tls"`                                     //是否使用TLS连接
+	TLSSkipVerify bool     `json:"tls-skip-verify,omitempty" yaml:"tls-skip-verify" mapstructure:"tls-skip-verify"` //是否跳过证书校验
+}
+
+// IsSet 是否配置了redis地址
+func (r Redis) IsSet() bool {
+	return r.Addr != "" || len(r.Addrs) > 0
 }
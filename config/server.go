@@ -5,4 +5,6 @@ type Server struct {
 	Database Database `mapstructure:"database" json:"database" yaml:"database"`
 	Redis    Redis    `mapstructure:"redis" json:"redis" yaml:"redis"`
 	Zap      Zap      `mapstructure:"zap" json:"zap" yaml:"zap"`
+	//关闭时等待任务停止和接口请求完成的时间,单位秒 默认30
+	ShutdownTimeout int `mapstructure:"shutdown-timeout" json:"shutdown-timeout" yaml:"shutdown-timeout"`
 }
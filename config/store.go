@@ -0,0 +1,19 @@
+package config
+
+type Store struct {
+	Type              string `json:"type,omitempty" yaml:"type" mapstructure:"type"`                                           //存储器类型 redis: 默认 bloom: redis布隆过滤器 memory: 进程内存储,不依赖redis file: 本地文件持久化 也可以是通过tong.RegisterStore注册的存储器
+	Dir               string `json:"dir,omitempty" yaml:"dir" mapstructure:"dir"`                                              //file存储器的数据目录 默认为./data
+	Sync              bool   `json:"sync,omitempty" yaml:"sync" mapstructure:"sync"`                                           //file存储器每次写入后是否立即刷盘
+	SegmentSize       int    `json:"segment-size,omitempty" yaml:"segment-size" mapstructure:"segment-size"`                   //file存储器日志分段大小,单位MB 默认64
+	VisibilityTimeout int    `json:"visibility-timeout,omitempty" yaml:"visibility-timeout" mapstructure:"visibility-timeout"` //队列请求出队后的确认超时时间,超时未确认则放回队列,单位秒 默认600
+	IdleTimeout       int    `json:"idle-timeout,omitempty" yaml:"idle-timeout" mapstructure:"idle-timeout"`                   //队列为空且所有进程都没有处理中的请求后,再等待多久没有新请求才算执行完成,单位秒 默认0
+}
+
+// Fingerprint 队列请求去重的指纹配置,不开启任何选项时只对GET请求按url去重
+type Fingerprint struct {
+	Method     bool     `json:"method,omitempty" yaml:"method" mapstructure:"method"`                //指纹包含请求方法
+	Body       bool     `json:"body,omitempty" yaml:"body" mapstructure:"body"`                      //指纹包含请求体,开启后非GET请求也会去重
+	Headers    []string `json:"headers,omitempty" yaml:"headers" mapstructure:"headers"`             //参与计算指纹的请求头
+	DropParams []string `json:"drop-params,omitempty" yaml:"drop-params" mapstructure:"drop-params"` //不参与计算指纹的query参数名称,支持正则 如: utm_.*
+	SortParams bool     `json:"sort-params,omitempty" yaml:"sort-params" mapstructure:"sort-params"` //query参数排序后计算指纹
+}
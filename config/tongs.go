@@ -1,13 +1,46 @@
 package config
 
 type Tongs struct {
-	Ua        []UserAgent `json:"ua,omitempty" yaml:"ua" mapstructure:"ua"`                      //ua列表
-	AutoUa    bool        `json:"auto-ua" yaml:"auto-ua" mapstructure:"auto-ua"`                 //自动设置ua
-	AutoDelay bool        `json:"auto-delay" yaml:"auto-delay" mapstructure:"auto-delay"`        //自动设置随机delay
-	Save      Save        `json:"save" yaml:"save" mapstructure:"save"`                          //设置保存item
-	MaxDepth  int         `json:"max-depth,omitempty" yaml:"max-depth" mapstructure:"max-depth"` //最大深度
-	Bloom     Bloom       `json:"bloom,omitempty" yaml:"bloom" mapstructure:"bloom"`             //布隆过滤器
-	Redis     Redis       `mapstructure:"redis" json:"redis" yaml:"redis"`                       //存储请求、队列等信息的redis客户端 为空则向上查找
+	Ua          []UserAgent `json:"ua,omitempty" yaml:"ua" mapstructure:"ua"`                            //ua列表
+	AutoUa      bool        `json:"auto-ua" yaml:"auto-ua" mapstructure:"auto-ua"`                       //自动设置ua
+	AutoDelay   bool        `json:"auto-delay" yaml:"auto-delay" mapstructure:"auto-delay"`              //自动设置随机delay
+	Save        Save        `json:"save" yaml:"save" mapstructure:"save"`                                //设置保存item
+	MaxDepth    int         `json:"max-depth,omitempty" yaml:"max-depth" mapstructure:"max-depth"`       //最大深度
+	Bloom       Bloom       `json:"bloom,omitempty" yaml:"bloom" mapstructure:"bloom"`                   //布隆过滤器
+	Store       Store       `json:"store,omitempty" yaml:"store" mapstructure:"store"`                   //请求、队列等信息的存储器
+	Redis       Redis       `mapstructure:"redis" json:"redis" yaml:"redis"`                             //存储请求、队列等信息的redis客户端 为空则向上查找
+	Tasks       []Task      `json:"tasks,omitempty" yaml:"tasks" mapstructure:"tasks"`                   //单个任务的配置
+	Fingerprint Fingerprint `json:"fingerprint,omitempty" yaml:"fingerprint" mapstructure:"fingerprint"` //队列请求去重的指纹
+	Identity    Identity    `json:"identity,omitempty" yaml:"identity" mapstructure:"identity"`          //多账号cookie
+	Retry       Retry       `json:"retry,omitempty" yaml:"retry" mapstructure:"retry"`                   //失败请求重试
+	KeyPrefix   string      `json:"key-prefix,omitempty" yaml:"key-prefix" mapstructure:"key-prefix"`    //redis中所有key的前缀 如: prod 为空不加前缀
+	Namespaces  []Namespace `json:"namespaces,omitempty" yaml:"namespaces" mapstructure:"namespaces"`    //单个Tongs的key前缀
+	Schedules   []Schedule  `json:"schedules,omitempty" yaml:"schedules" mapstructure:"schedules"`       //定时执行Tongs或任务
+	Worker      Worker      `json:"worker,omitempty" yaml:"worker" mapstructure:"worker"`                //多进程协作
+}
+
+// Worker 多进程协作配置,开启后进程在redis中注册并定时上报心跳,通过接口启动、停止任务的命令同步到所有进程
+type Worker struct {
+	Open      bool   `json:"open,omitempty" yaml:"open" mapstructure:"open"`                //是否开启
+	Name      string `json:"name,omitempty" yaml:"name" mapstructure:"name"`                //进程名称 为空则使用 主机名-进程号
+	Heartbeat int    `json:"heartbeat,omitempty" yaml:"heartbeat" mapstructure:"heartbeat"` //心跳间隔,单位秒 默认5
+	Ttl       int    `json:"ttl,omitempty" yaml:"ttl" mapstructure:"ttl"`                   //超过多久没有心跳视为下线,单位秒 默认为心跳间隔的3倍
+	Lease     int    `json:"lease,omitempty" yaml:"lease" mapstructure:"lease"`             //主进程租约时间,主进程退出后最多经过该时间由其他进程接替,单位秒 默认与ttl相同
+}
+
+// Schedule 定时执行配置,任务名称为空时定时执行整个Tongs
+type Schedule struct {
+	Tongs    string `json:"tongs" yaml:"tongs" mapstructure:"tongs"`                    //Tongs名称
+	Task     string `json:"task,omitempty" yaml:"task" mapstructure:"task"`             //任务名称 为空则执行Tongs内所有任务
+	Cron     string `json:"cron" yaml:"cron" mapstructure:"cron"`                       //cron表达式 如: 0 2 * * * 或 @every 30m
+	Overlap  string `json:"overlap,omitempty" yaml:"overlap" mapstructure:"overlap"`    //上一次还在运行时的处理方式 skip: 默认 跳过 queue: 结束后再执行 replace: 停止后重新执行
+	Disabled bool   `json:"disabled,omitempty" yaml:"disabled" mapstructure:"disabled"` //是否暂停定时执行
+}
+
+// Namespace 单个Tongs的redis key前缀,通过Tongs名称匹配
+type Namespace struct {
+	Tongs     string `json:"tongs" yaml:"tongs" mapstructure:"tongs"`                          //Tongs名称
+	KeyPrefix string `json:"key-prefix,omitempty" yaml:"key-prefix" mapstructure:"key-prefix"` //key前缀 为空则使用代码设置或tongs.key-prefix
 }
 
 // UserAgent 请求头
@@ -16,10 +49,44 @@ type UserAgent struct {
 	Values []string `json:"values,omitempty" yaml:"label" mapstructure:"values"` //组内所有请求头
 }
 
+// Task 单个任务的配置,通过Tongs名称和任务名称匹配
+type Task struct {
+	Tongs       string       `json:"tongs" yaml:"tongs" mapstructure:"tongs"`                                //Tongs名称
+	Task        string       `json:"task" yaml:"task" mapstructure:"task"`                                   //任务名称
+	Store       string       `json:"store,omitempty" yaml:"store" mapstructure:"store"`                      //存储器类型 为空则使用tongs.store.type
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty" yaml:"fingerprint" mapstructure:"fingerprint"`    //队列请求去重的指纹 为空则使用tongs.fingerprint
+	Freshness   int          `json:"freshness,omitempty" yaml:"freshness" mapstructure:"freshness"`          //访问记录有效期,单位小时 过期后再次添加的请求会重新抓取 为0则使用任务代码设置
+	Identity    *Identity    `json:"identity,omitempty" yaml:"identity" mapstructure:"identity"`             //多账号cookie 为空则使用任务代码设置或tongs.identity
+	Retry       *Retry       `json:"retry,omitempty" yaml:"retry" mapstructure:"retry"`                      //失败请求重试 为空则使用任务代码设置或tongs.retry
+	Depends     []Dependency `json:"depends,omitempty" yaml:"depends" mapstructure:"depends"`                //依赖的上游任务 为空则使用任务代码设置
+	IdleTimeout int          `json:"idle-timeout,omitempty" yaml:"idle-timeout" mapstructure:"idle-timeout"` //队列空闲超时时间,单位秒 为0则使用任务代码设置或tongs.store.idle-timeout
+}
+
+// Dependency 任务依赖,通过Tongs启动时上游任务结束且满足条件后才启动
+type Dependency struct {
+	Task string `json:"task" yaml:"task" mapstructure:"task"`     //上游任务名称
+	On   string `json:"on,omitempty" yaml:"on" mapstructure:"on"` //启动条件 success: 默认 上游执行完成 failure: 上游执行失败 complete: 上游结束
+}
+
+// Retry 失败请求的重试策略,超过重试次数后写入死信队列
+type Retry struct {
+	MaxRetries int   `json:"max-retries,omitempty" yaml:"max-retries" mapstructure:"max-retries"` //最大重试次数 为0不重试
+	Backoff    int   `json:"backoff,omitempty" yaml:"backoff" mapstructure:"backoff"`             //第一次重试前等待的秒数,之后每次翻倍
+	Status     []int `json:"status,omitempty" yaml:"status" mapstructure:"status"`                //需要重试的状态码 为空则所有错误都重试,网络错误的状态码为0
+}
+
+// Identity 多账号cookie配置,账号通过接口导入,同一Tongs内的任务共用账号
+type Identity struct {
+	Rotation     string `json:"rotation,omitempty" yaml:"rotation" mapstructure:"rotation"`                //轮换策略 为空不启用 request: 每个请求轮换 session: 每次运行使用一个账号,停用后切换
+	RetireStatus []int  `json:"retire-status,omitempty" yaml:"retire-status" mapstructure:"retire-status"` //响应这些状态码时停用当前账号 如: 403,429
+}
+
 type Bloom struct {
-	Open  bool  `json:"open" yaml:"open" mapstructure:"open"`              //开启redis布隆过滤器
-	Alone bool  `json:"alone,omitempty" yaml:"alone" mapstructure:"alone"` //true: 每个Task独立使用过滤器 false: 一个Tongs内的Task使用一个
-	Redis Redis `mapstructure:"redis" json:"redis" yaml:"redis"`           //支持布隆过滤器的redis客户端 为空则向上查找
+	Open      bool    `json:"open" yaml:"open" mapstructure:"open"`                             //开启redis布隆过滤器
+	Alone     bool    `json:"alone,omitempty" yaml:"alone" mapstructure:"alone"`                //true: 每个Task独立使用过滤器 false: 一个Tongs内的Task使用一个
+	Redis     Redis   `mapstructure:"redis" json:"redis" yaml:"redis"`                          //支持布隆过滤器的redis客户端 为空则向上查找 未加载RedisBloom模块时使用bitmap实现
+	Capacity  int64   `json:"capacity,omitempty" yaml:"capacity" mapstructure:"capacity"`       //过滤器容量 默认1000000
+	ErrorRate float64 `json:"error-rate,omitempty" yaml:"error-rate" mapstructure:"error-rate"` //误判率 默认0.001
 }
 
 type Save struct {
@@ -11,7 +11,7 @@ import (
 
 var (
 	DB           *gorm.DB
-	Redis        *redis.Client
+	Redis        redis.UniversalClient
 	Log          *zap.Logger
 	CONFIG       config.Config
 	VP           *viper.Viper
@@ -1,6 +1,8 @@
 package initialize
 
 import (
+	"crypto/tls"
+	"fmt"
 	"github.com/go-redis/redis"
 	"gorm.io/driver/mysql"
 	"gorm.io/driver/postgres"
@@ -69,38 +71,83 @@ func initPostGreSql(config config.Pgsql) *gorm.DB {
 }
 
 func InitRedis() {
-	rdb := redis.NewClient(&redis.Options{
-		Network:  "tcp",
-		Addr:     global.CONFIG.Server.Redis.Addr,
-		Password: global.CONFIG.Server.Redis.Password, // no password set
-		DB:       0,                                   // use default DB
-	})
+	rdb := newRedis(global.CONFIG.Server.Redis)
 	//Tongs的redis
-	if global.CONFIG.Tongs.Redis.Addr != "" {
-		tong.Redis = redis.NewClient(&redis.Options{
-			Network:  "tcp",
-			Addr:     global.CONFIG.Tongs.Redis.Addr,
-			Password: global.CONFIG.Tongs.Redis.Password, // no password set
-			DB:       0,                                  // use default DB
-		})
+	if global.CONFIG.Tongs.Redis.IsSet() {
+		tong.Redis = newRedis(global.CONFIG.Tongs.Redis)
 	} else {
 		tong.Redis = rdb
 	}
-	if global.CONFIG.Tongs.Bloom.Open {
-		if global.CONFIG.Tongs.Bloom.Redis.Addr != "" {
-			tong.BloomRedis = redis.NewClient(&redis.Options{
-				Network:  "tcp",
-				Addr:     global.CONFIG.Tongs.Bloom.Redis.Addr,
-				Password: global.CONFIG.Tongs.Bloom.Redis.Password, // no password set
-				DB:       0,                                        // use default DB
-			})
-		} else {
-			tong.BloomRedis = tong.Redis
-		}
+	//布隆过滤器的redis 任务可以单独指定bloom存储器,所以未开启时也需要初始化
+	if global.CONFIG.Tongs.Bloom.Redis.IsSet() {
+		tong.BloomRedis = newRedis(global.CONFIG.Tongs.Bloom.Redis)
+	} else {
+		tong.BloomRedis = tong.Redis
 	}
 	global.Redis = rdb
 }
 
+// newRedis 按部署模式创建redis客户端
+func newRedis(c config.Redis) redis.UniversalClient {
+	addrs := c.Addrs
+	if len(addrs) == 0 && c.Addr != "" {
+		addrs = []string{c.Addr}
+	}
+	var tlsConfig *tls.Config
+	if c.TLS {
+		tlsConfig = &tls.Config{InsecureSkipVerify: c.TLSSkipVerify}
+	}
+	dial := time.Duration(c.DialTimeout) * time.Millisecond
+	read := time.Duration(c.ReadTimeout) * time.Millisecond
+	write := time.Duration(c.WriteTimeout) * time.Millisecond
+	switch c.Mode {
+	case "", "single":
+		return redis.NewClient(&redis.Options{
+			Network:      "tcp",
+			Addr:         c.Addr,
+			Password:     c.Password,
+			DB:           c.DB,
+			PoolSize:     c.PoolSize,
+			MinIdleConns: c.MaxIdl,
+			DialTimeout:  dial,
+			ReadTimeout:  read,
+			WriteTimeout: write,
+			TLSConfig:    tlsConfig,
+		})
+	case "sentinel":
+		if c.MasterName == "" {
+			panic("redis哨兵模式需要配置master-name")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    c.MasterName,
+			SentinelAddrs: addrs,
+			Password:      c.Password,
+			DB:            c.DB,
+			PoolSize:      c.PoolSize,
+			MinIdleConns:  c.MaxIdl,
+			DialTimeout:   dial,
+			ReadTimeout:   read,
+			WriteTimeout:  write,
+			TLSConfig:     tlsConfig,
+		})
+	case "cluster":
+		if c.DB != 0 {
+			panic("redis集群模式只能使用db 0")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:        addrs,
+			Password:     c.Password,
+			PoolSize:     c.PoolSize,
+			MinIdleConns: c.MaxIdl,
+			DialTimeout:  dial,
+			ReadTimeout:  read,
+			WriteTimeout: write,
+			TLSConfig:    tlsConfig,
+		})
+	}
+	panic(fmt.Sprintf("不支持的redis模式【%s】", c.Mode))
+}
+
 // Config gorm 自定义配置
 func generateGormConfig(prefix string, singular bool) *gorm.Config {
 	config := &gorm.Config{
@@ -13,11 +13,45 @@ func InitRouter() (e *gin.Engine) {
 	http.GET("tongs/detail", api.GetTongs)
 	http.POST("tongs/run", api.RunTongs)
 	http.POST("tongs/stop", api.StopTongs)
+	http.POST("tongs/reset", api.ResetTongs)
+	http.GET("tongs/identity", api.GetIdentities)
+	http.POST("tongs/identity/import", api.ImportIdentity)
+	http.POST("tongs/identity/retire", api.RetireIdentity)
+	http.POST("tongs/identity/remove", api.RemoveIdentity)
+	http.GET("tongs/export", api.ExportTongs)
+	http.POST("tongs/import", api.ImportTongs)
+	http.GET("tongs/keys", api.GetKeys)
+	http.GET("tongs/graph", api.GetGraph)
 
 	http.GET("task", api.GetTasks)
 	http.GET("task/detail", api.GetTasks)
 	http.POST("task/run", api.RunTask)
 	http.POST("task/stop", api.StopTask)
+	http.POST("task/pause", api.PauseTask)
+	http.POST("task/resume", api.ResumeTask)
+	http.GET("task/transitions", api.GetTransitions)
+	http.POST("task/reset", api.ResetTask)
 	http.POST("task/addUrl", api.AddUrl)
+	http.GET("task/queue", api.GetQueue)
+	http.GET("task/queue/peek", api.PeekQueue)
+	http.GET("task/queue/search", api.SearchQueue)
+	http.POST("task/queue/remove", api.RemoveQueued)
+	http.POST("task/queue/move", api.MoveQueued)
+	http.GET("task/dead", api.GetDeadLetters)
+	http.POST("task/dead/replay", api.ReplayDeadLetters)
+	http.POST("task/dead/purge", api.PurgeDeadLetters)
+	http.GET("task/export", api.ExportTask)
+	http.POST("task/import", api.ImportTask)
+	http.GET("task/history", api.GetHistory)
+	http.GET("task/history/detail", api.GetHistoryRun)
+
+	http.GET("workers", api.GetWorkers)
+	http.GET("workers/leader", api.GetLeader)
+
+	http.GET("schedule", api.GetSchedules)
+	http.POST("schedule/set", api.SetSchedule)
+	http.POST("schedule/enable", api.EnableSchedule)
+	http.POST("schedule/disable", api.DisableSchedule)
+	http.POST("schedule/remove", api.RemoveSchedule)
 	return http
 }
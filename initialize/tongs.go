@@ -1,6 +1,7 @@
 package initialize
 
 import (
+	"fmt"
 	"tongs/global"
 	"tongs/tong"
 )
@@ -8,6 +9,9 @@ import (
 func InitTongs() {
 	tong.Config = global.CONFIG.Tongs
 	tong.Log = global.Log
+	if err := tong.InitHistory(global.DB); err != nil {
+		panic(fmt.Sprintf("运行记录表初始化失败,error:%s", err.Error()))
+	}
 	for _, ua := range tong.Config.Ua {
 		tong.UserAgents[ua.Label] = ua.Values
 	}
@@ -1,7 +1,42 @@
 package model
 
 type Param struct {
-	Tongs string `json:"tongs,omitempty"`
-	Task  string `json:"task,omitempty"`
-	Url   string `json:"url,omitempty"`
+	Tongs    string `json:"tongs,omitempty"`
+	Task     string `json:"task,omitempty"`
+	Url      string `json:"url,omitempty"`
+	Priority int    `json:"priority,omitempty"` //队列优先级,数值越大越先执行 为0则按请求深度
+	Delay    int    `json:"delay,omitempty"`    //延迟执行的秒数,仅队列任务有效
+	Reset    string `json:"reset,omitempty"`    //重置内容 queue,visited,cookies,all 多个使用逗号分隔
+}
+
+// QueueParam 队列删除、移动请求参数
+type QueueParam struct {
+	Tongs   string   `json:"tongs,omitempty"`
+	Task    string   `json:"task,omitempty"`
+	Urls    []string `json:"urls,omitempty"`    //要删除或移动的请求url
+	ToTongs string   `json:"toTongs,omitempty"` //移动到的Tongs 为空则为当前Tongs
+	ToTask  string   `json:"toTask,omitempty"`  //移动到的任务
+}
+
+// DeadLetterParam 死信重放、清空参数
+type DeadLetterParam struct {
+	Tongs string   `json:"tongs,omitempty"`
+	Task  string   `json:"task,omitempty"`
+	Ids   []string `json:"ids,omitempty"` //要重放的死信 为空则重放全部
+}
+
+// IdentityParam 账号导入、停用、删除参数
+type IdentityParam struct {
+	Tongs   string            `json:"tongs,omitempty"`
+	Name    string            `json:"name,omitempty"`    //账号名称
+	Cookies map[string]string `json:"cookies,omitempty"` //host -> cookie请求头 如: {"www.example.com": "a=1; b=2"}
+	Reason  string            `json:"reason,omitempty"`  //停用原因
+}
+
+// ScheduleParam 定时设置、开启、暂停、删除参数
+type ScheduleParam struct {
+	Tongs   string `json:"tongs,omitempty"`
+	Task    string `json:"task,omitempty"`    //任务名称 为空则定时执行整个Tongs
+	Cron    string `json:"cron,omitempty"`    //cron表达式 如: 0 2 * * * 或 @every 30m
+	Overlap string `json:"overlap,omitempty"` //上一次还在运行时的处理方式 skip queue replace 默认skip
 }
@@ -0,0 +1,274 @@
+package tong
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	bloomCapacityDefault  = 1000000 //布隆过滤器默认容量
+	bloomErrorRateDefault = 0.001   //布隆过滤器默认误判率
+	bloomBitsMax          = 1 << 32 //redis字符串最大512MB
+	bloomProbeKey         = "tongs:bloom:probe"
+	bloomChunkSize        = 1 << 20 //bitmap导出时每块的字节数
+)
+
+var (
+	bloomModules   = make(map[redis.UniversalClient]bool)
+	bloomModulesMu sync.Mutex
+)
+
+// bloomFilter 布隆过滤器在redis中的实现,支持RedisBloom模块时使用模块命令,否则使用bitmap实现
+type bloomFilter interface {
+	// reserve 按配置的容量和误判率创建过滤器,过滤器已存在时忽略
+	reserve(c redis.UniversalClient, key string) error
+	// add 添加元素,返回的函数在管道执行后获取元素是否是新添加的
+	add(pipe redis.Pipeliner, key string, member uint64) func() bool
+	// exists 判断元素是否存在,返回的函数在管道执行后获取结果
+	exists(pipe redis.Pipeliner, key string, member uint64) func() bool
+	// expire 设置过滤器的过期时间
+	expire(pipe redis.Pipeliner, key string, ttl time.Duration)
+	// kind 过滤器实现,导入时两边的实现需要一致
+	kind() string
+	// dump 分块导出过滤器,过滤器不存在时不调用fn
+	dump(c redis.UniversalClient, key string, fn func(iter int64, data []byte) error) error
+	// load 按导出顺序导入分块
+	load(c redis.UniversalClient, key string, iter int64, data []byte) error
+}
+
+// newBloomFilter 检测redis是否支持RedisBloom模块并创建对应的过滤器
+func newBloomFilter(c redis.UniversalClient) (bloomFilter, error) {
+	capacity := Config.Bloom.Capacity
+	if capacity <= 0 {
+		capacity = bloomCapacityDefault
+	}
+	errorRate := Config.Bloom.ErrorRate
+	if errorRate <= 0 || errorRate >= 1 {
+		errorRate = bloomErrorRateDefault
+	}
+	module, err := hasBloomModule(c)
+	if err != nil {
+		return nil, err
+	}
+	if module {
+		return &moduleBloom{capacity: capacity, errorRate: errorRate}, nil
+	}
+	return newBitmapBloom(capacity, errorRate), nil
+}
+
+// hasBloomModule 检测结果按客户端缓存,同一个redis只检测一次
+func hasBloomModule(c redis.UniversalClient) (bool, error) {
+	bloomModulesMu.Lock()
+	defer bloomModulesMu.Unlock()
+	if module, ok := bloomModules[c]; ok {
+		return module, nil
+	}
+	module := true
+	if err := redisDo(c, "BF.EXISTS", bloomProbeKey, 0).Err(); err != nil && err != redis.Nil {
+		if !strings.Contains(strings.ToLower(err.Error()), "unknown command") {
+			return false, err
+		}
+		module = false
+		Log.Info("redis未加载RedisBloom模块,布隆过滤器使用bitmap实现")
+	}
+	bloomModules[c] = module
+	return module, nil
+}
+
+// moduleBloom 使用RedisBloom模块的过滤器
+type moduleBloom struct {
+	capacity  int64
+	errorRate float64
+}
+
+func (b *moduleBloom) reserve(c redis.UniversalClient, key string) error {
+	err := redisDo(c, "BF.RESERVE", key, b.errorRate, b.capacity).Err()
+	if err != nil && !strings.Contains(strings.ToLower(err.Error()), "exists") {
+		return err
+	}
+	return nil
+}
+
+// add 使用BF.INSERT,过滤器不存在时按配置的容量和误判率创建
+func (b *moduleBloom) add(pipe redis.Pipeliner, key string, member uint64) func() bool {
+	cmd := pipe.Do("BF.INSERT", key, "CAPACITY", b.capacity, "ERROR", b.errorRate, "ITEMS", member)
+	return func() bool {
+		//每个元素返回1表示新添加,0表示可能已存在
+		values, _ := cmd.Val().([]interface{})
+		if len(values) == 0 {
+			return false
+		}
+		added, _ := values[0].(int64)
+		return added == 1
+	}
+}
+
+func (b *moduleBloom) exists(pipe redis.Pipeliner, key string, member uint64) func() bool {
+	cmd := pipe.Do("BF.EXISTS", key, member)
+	return func() bool {
+		exists, _ := cmd.Bool()
+		return exists
+	}
+}
+
+func (b *moduleBloom) expire(pipe redis.Pipeliner, key string, ttl time.Duration) {
+	pipe.Expire(key, ttl)
+}
+
+func (b *moduleBloom) kind() string {
+	return "module"
+}
+
+// dump 使用BF.SCANDUMP分块导出,迭代器为0时结束
+func (b *moduleBloom) dump(c redis.UniversalClient, key string, fn func(iter int64, data []byte) error) error {
+	if n, err := c.Exists(key).Result(); err != nil || n == 0 {
+		return err
+	}
+	var iter int64
+	for {
+		res, err := redisDo(c, "BF.SCANDUMP", key, iter).Result()
+		if err != nil {
+			return err
+		}
+		values, ok := res.([]interface{})
+		if !ok || len(values) != 2 {
+			return errors.New(fmt.Sprintf("BF.SCANDUMP返回格式错误: %v", res))
+		}
+		iter, _ = values[0].(int64)
+		if iter == 0 {
+			return nil
+		}
+		data, _ := values[1].(string)
+		if err := fn(iter, []byte(data)); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *moduleBloom) load(c redis.UniversalClient, key string, iter int64, data []byte) error {
+	return redisDo(c, "BF.LOADCHUNK", key, iter, data).Err()
+}
+
+// bitmapBloom 基于redis bitmap的过滤器,使用SETBIT/GETBIT和双重哈希计算的多个位置
+// 位数组大小在创建时按容量和误判率确定,超过容量后误判率会升高
+type bitmapBloom struct {
+	bits   uint64
+	hashes int
+}
+
+func newBitmapBloom(capacity int64, errorRate float64) *bitmapBloom {
+	n := float64(capacity)
+	m := math.Ceil(-n * math.Log(errorRate) / (math.Ln2 * math.Ln2))
+	if m > bloomBitsMax {
+		m = bloomBitsMax
+	}
+	k := int(math.Round(m / n * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bitmapBloom{bits: uint64(m), hashes: k}
+}
+
+// reserve bitmap在写入时自动扩展,无需提前创建
+func (b *bitmapBloom) reserve(c redis.UniversalClient, key string) error {
+	return nil
+}
+
+// add SETBIT返回原来的值,任意一位原来为0时元素是新添加的
+func (b *bitmapBloom) add(pipe redis.Pipeliner, key string, member uint64) func() bool {
+	offsets := b.offsets(member)
+	cmds := make([]*redis.IntCmd, len(offsets))
+	for i, offset := range offsets {
+		cmds[i] = pipe.SetBit(b.key(key), int64(offset), 1)
+	}
+	return func() bool {
+		for _, cmd := range cmds {
+			if cmd.Val() == 0 {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func (b *bitmapBloom) exists(pipe redis.Pipeliner, key string, member uint64) func() bool {
+	offsets := b.offsets(member)
+	cmds := make([]*redis.IntCmd, len(offsets))
+	for i, offset := range offsets {
+		cmds[i] = pipe.GetBit(b.key(key), int64(offset))
+	}
+	return func() bool {
+		for _, cmd := range cmds {
+			if cmd.Val() != 1 {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func (b *bitmapBloom) expire(pipe redis.Pipeliner, key string, ttl time.Duration) {
+	pipe.Expire(b.key(key), ttl)
+}
+
+func (b *bitmapBloom) kind() string {
+	return "bitmap"
+}
+
+// dump 按bloomChunkSize分块导出bitmap,iter为分块的字节偏移
+func (b *bitmapBloom) dump(c redis.UniversalClient, key string, fn func(iter int64, data []byte) error) error {
+	size, err := c.StrLen(b.key(key)).Result()
+	if err != nil {
+		return err
+	}
+	for offset := int64(0); offset < size; offset += bloomChunkSize {
+		data, err := c.GetRange(b.key(key), offset, offset+bloomChunkSize-1).Result()
+		if err != nil {
+			return err
+		}
+		if err := fn(offset, []byte(data)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *bitmapBloom) load(c redis.UniversalClient, key string, iter int64, data []byte) error {
+	return c.SetRange(b.key(key), iter, string(data)).Err()
+}
+
+// key bitmap与模块过滤器使用不同的key,避免redis加载模块后类型冲突
+func (b *bitmapBloom) key(key string) string {
+	return fmt.Sprintf("%s:bitmap", key)
+}
+
+// offsets 双重哈希 h1 + i*h2 计算元素在位数组中的位置
+func (b *bitmapBloom) offsets(member uint64) []uint64 {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, member)
+	h := fnv.New64a()
+	h.Write(buf)
+	h1 := h.Sum64()
+	h2 := mix64(member) | 1
+	offsets := make([]uint64, b.hashes)
+	for i := range offsets {
+		offsets[i] = (h1 + uint64(i)*h2) % b.bits
+	}
+	return offsets
+}
+
+// mix64 splitmix64的混淆函数,作为第二个哈希
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
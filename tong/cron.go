@@ -0,0 +1,223 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule cron表达式,支持5个字段: 分 时 日 月 周
+// 每个字段支持 * 、数字、范围 a-b 、步长 */n a-b/n 以及逗号分隔的列表,月和周支持英文缩写 如: JAN MON
+// 同时指定了日和周时满足其一即可,与标准cron一致
+// 也支持 @yearly @monthly @weekly @daily @hourly 和 @every 10m 这样的固定间隔
+type CronSchedule struct {
+	Expr   string
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	domAll bool          //日为*
+	dowAll bool          //周为*
+	every  time.Duration //@every 固定间隔
+}
+
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cronFields = []cronField{
+		{name: "分", min: 0, max: 59},
+		{name: "时", min: 0, max: 23},
+		{name: "日", min: 1, max: 31},
+		{name: "月", min: 1, max: 12, names: map[string]int{
+			"JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6,
+			"JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12,
+		}},
+		{name: "周", min: 0, max: 7, names: map[string]int{
+			"SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6,
+		}},
+	}
+	cronDescriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// ParseCron 解析cron表达式
+func ParseCron(expr string) (*CronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if strings.HasPrefix(expr, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expr, "@every ")))
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("cron表达式【%s】间隔错误: %s", expr, err.Error()))
+		}
+		if d < time.Second {
+			return nil, errors.New(fmt.Sprintf("cron表达式【%s】间隔不能小于1秒", expr))
+		}
+		return &CronSchedule{Expr: expr, every: d}, nil
+	}
+	spec := expr
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		spec = d
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, errors.New(fmt.Sprintf("cron表达式【%s】需要5个字段: 分 时 日 月 周", expr))
+	}
+	bits := make([]uint64, len(fields))
+	for i, f := range fields {
+		b, err := parseCronField(f, cronFields[i])
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("cron表达式【%s】%s", expr, err.Error()))
+		}
+		bits[i] = b
+	}
+	//周日可以写为0或7
+	if bits[4]&(1<<7) != 0 {
+		bits[4] |= 1
+	}
+	c := &CronSchedule{
+		Expr:   expr,
+		minute: bits[0],
+		hour:   bits[1],
+		dom:    bits[2],
+		month:  bits[3],
+		dow:    bits[4],
+		domAll: fields[2] == "*" || fields[2] == "?",
+		dowAll: fields[4] == "*" || fields[4] == "?",
+	}
+	if c.Next(time.Now()).IsZero() {
+		return nil, errors.New(fmt.Sprintf("cron表达式【%s】没有满足条件的执行时间", expr))
+	}
+	return c, nil
+}
+
+func parseCronField(s string, f cronField) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(s, ",") {
+		lo, hi, step := f.min, f.max, 1
+		rng := part
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, errors.New(fmt.Sprintf("%s字段步长【%s】错误", f.name, part))
+			}
+			step = n
+			rng = part[:i]
+		}
+		if rng != "*" && rng != "?" {
+			if i := strings.Index(rng, "-"); i >= 0 {
+				var err error
+				if lo, err = f.value(rng[:i]); err != nil {
+					return 0, err
+				}
+				if hi, err = f.value(rng[i+1:]); err != nil {
+					return 0, err
+				}
+			} else {
+				v, err := f.value(rng)
+				if err != nil {
+					return 0, err
+				}
+				lo = v
+				//单个值带步长时表示从该值到最大值
+				if step == 1 {
+					hi = v
+				}
+			}
+		}
+		if lo > hi {
+			return 0, errors.New(fmt.Sprintf("%s字段范围【%s】错误", f.name, part))
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(s string) (int, error) {
+	if v, ok := f.names[strings.ToUpper(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, errors.New(fmt.Sprintf("%s字段的值【%s】超出范围%d-%d", f.name, s, f.min, f.max))
+	}
+	return v, nil
+}
+
+// Next 获取t之后的下一次执行时间,没有满足条件的时间时返回零值
+// 夏令时开始时跳过的时间不执行,夏令时结束时重复的时间只执行一次
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	if c.every > 0 {
+		return t.Add(c.every).Truncate(time.Second)
+	}
+	from := wallClock(t)
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	//5年内没有满足条件的时间则认为表达式无效 如: 2月30日
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if c.month&(1<<uint(t.Month())) == 0 {
+			t = forward(t, time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if !c.dayMatches(t) {
+			t = forward(t, time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location()))
+			continue
+		}
+		if c.hour&(1<<uint(t.Hour())) == 0 {
+			//按实际时间前进到下一个整点,不存在的整点由time.Date解析后会回到更早的时间
+			t = t.Add(time.Duration(60-t.Minute()) * time.Minute)
+			continue
+		}
+		if c.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		if !wallClock(t).After(from) {
+			//时钟回拨后重复的时间
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
+
+// forward 前进到next,next在夏令时开始时不存在会被解析为不晚于t的时间,此时按实际时间前进一小时
+func forward(t, next time.Time) time.Time {
+	if next.After(t) {
+		return next
+	}
+	return t.Add(time.Hour)
+}
+
+// wallClock 忽略时区偏移的本地时间,用于比较时钟回拨前后的时间
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), 0, 0, time.UTC)
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAll || c.dowAll {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+func (c *CronSchedule) String() string {
+	return c.Expr
+}
@@ -0,0 +1,87 @@
+package tong
+
+import (
+	"testing"
+	"time"
+	_ "time/tzdata"
+)
+
+func TestParseCronError(t *testing.T) {
+	cases := []struct {
+		name string
+		expr string
+	}{
+		{"字段数量", "* * *"},
+		{"超出范围", "60 * * * *"},
+		{"范围颠倒", "30-10 * * * *"},
+		{"步长为0", "*/0 * * * *"},
+		{"不存在的日期", "0 0 30 2 *"},
+		{"间隔过小", "@every 500ms"},
+		{"间隔错误", "@every 1x"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if _, err := ParseCron(c.expr); err == nil {
+				t.Fatalf("ParseCron(%q) 应返回错误", c.expr)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name string
+		expr string
+		loc  *time.Location
+		from string
+		want string
+	}{
+		//2026-10-18是周日
+		{"每分钟", "* * * * *", time.UTC, "2026-10-18 10:15:30", "2026-10-18 10:16:00"},
+		{"日和周满足其一", "0 0 13 * 5", time.UTC, "2026-10-18 00:00:00", "2026-10-23 00:00:00"},
+		{"日和周满足其一取日", "0 0 20 * 5", time.UTC, "2026-10-18 00:00:00", "2026-10-20 00:00:00"},
+		{"周为*时只按日", "0 0 13 * *", time.UTC, "2026-10-18 00:00:00", "2026-11-13 00:00:00"},
+		{"日为*时只按周", "0 0 * * 5", time.UTC, "2026-10-18 00:00:00", "2026-10-23 00:00:00"},
+		{"7为周日", "0 0 * * 7", time.UTC, "2026-10-17 12:00:00", "2026-10-18 00:00:00"},
+		{"范围包含7", "0 0 * * 6-7", time.UTC, "2026-10-18 12:00:00", "2026-10-24 00:00:00"},
+		{"英文缩写", "0 0 1 FEB MON", time.UTC, "2026-10-18 00:00:00", "2027-02-01 00:00:00"},
+		{"范围步长", "10-30/10 * * * *", time.UTC, "2026-10-18 00:05:00", "2026-10-18 00:10:00"},
+		{"范围步长跨小时", "10-30/10 * * * *", time.UTC, "2026-10-18 00:30:00", "2026-10-18 01:10:00"},
+		{"单个值步长", "5/20 * * * *", time.UTC, "2026-10-18 00:26:00", "2026-10-18 00:45:00"},
+		{"列表", "0 9,18 * * *", time.UTC, "2026-10-18 10:00:00", "2026-10-18 18:00:00"},
+		{"跳过没有31日的月份", "0 0 31 * *", time.UTC, "2026-10-31 00:00:00", "2026-12-31 00:00:00"},
+		{"闰年2月29日", "0 0 29 2 *", time.UTC, "2026-10-18 00:00:00", "2028-02-29 00:00:00"},
+		{"每天", "@daily", time.UTC, "2026-10-18 10:00:00", "2026-10-19 00:00:00"},
+		{"固定间隔", "@every 90s", time.UTC, "2026-10-18 10:00:00", "2026-10-18 10:01:30"},
+		//2026-03-08 02:00 夏令时开始,时钟跳到03:00,当天的02:30不存在
+		{"夏令时开始跳过不存在的时间", "30 2 * * *", newYork, "2026-03-08 00:00:00", "2026-03-09 02:30:00"},
+		{"夏令时开始当天", "0 3 * * *", newYork, "2026-03-08 00:00:00", "2026-03-08 03:00:00"},
+		{"夏令时开始每小时", "0 * * * *", newYork, "2026-03-08 01:00:00", "2026-03-08 03:00:00"},
+		//2026-11-01 02:00 夏令时结束,时钟回到01:00,01:30出现两次只执行一次
+		{"夏令时结束只执行一次", "30 1 * * *", newYork, "2026-11-01 01:30:00", "2026-11-02 01:30:00"},
+		{"夏令时结束每小时", "0 * * * *", newYork, "2026-11-01 01:00:00", "2026-11-01 02:00:00"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := ParseCron(c.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			from, err := time.ParseInLocation("2006-01-02 15:04:05", c.from, c.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := time.ParseInLocation("2006-01-02 15:04:05", c.want, c.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.Next(from); !got.Equal(want) {
+				t.Fatalf("Next(%s) = %s, want %s", from, got, want)
+			}
+		})
+	}
+}
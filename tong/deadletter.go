@@ -0,0 +1,419 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"tongs/config"
+
+	"github.com/go-redis/redis"
+	"github.com/gocolly/colly/v2"
+)
+
+// AttemptKey 请求重试次数在上下文中的key前缀,子请求与父请求共用上下文,所以按url区分
+const AttemptKey = "tongs:attempt"
+
+// DeadLetter 重试后仍然失败的请求
+type DeadLetter struct {
+	ID         string `json:"id"`
+	URL        string `json:"url"`
+	Method     string `json:"method"`
+	Error      string `json:"error"`
+	StatusCode int    `json:"statusCode"`
+	Attempts   int    `json:"attempts"` //失败次数
+	FailedAt   int64  `json:"failedAt"` //最后一次失败时间
+	Request    []byte `json:"request"`  //序列化的请求,重放时使用
+}
+
+// DeadLetterStore 支持死信队列的存储器
+type DeadLetterStore interface {
+	// AddDeadLetter 添加死信,ID相同时覆盖
+	AddDeadLetter(d *DeadLetter) error
+	// DeadLetters 按失败时间倒序获取从offset开始的最多n个死信,n小于0时获取全部
+	DeadLetters(offset, n int) ([]*DeadLetter, error)
+	// DeadLetterSize 死信数量
+	DeadLetterSize() (int, error)
+	// RemoveDeadLetter 删除死信,返回删除前的内容,不存在时返回nil
+	RemoveDeadLetter(id string) (*DeadLetter, error)
+	// PurgeDeadLetters 清空死信,返回清除的数量
+	PurgeDeadLetters() (int, error)
+}
+
+// retryPolicy 失败请求的重试策略
+type retryPolicy struct {
+	maxRetries int
+	backoff    time.Duration
+	status     []int
+}
+
+// initRetry 请求失败后按重试策略重试,超过重试次数后写入死信队列
+// 队列任务通过延迟请求重试,普通任务通过定时器重试,不占用请求线程
+func initRetry(t *Task) {
+	if tc := taskConfig(t); tc.Retry != nil {
+		t.retry = newRetryPolicy(*tc.Retry)
+	} else if t.retry == nil {
+		t.retry = newRetryPolicy(Config.Retry)
+	}
+	p := t.retry
+	dead, _ := t.store.(DeadLetterStore)
+	if p.maxRetries <= 0 && dead == nil {
+		return
+	}
+	t.collector.OnError(func(r *colly.Response, err error) {
+		req := r.Request
+		key := attemptKey(req)
+		attempts := 1
+		if n, ok := req.Ctx.GetAny(key).(int); ok {
+			attempts = n + 1
+		} else if n, ok := req.Ctx.GetAny(key).(float64); ok {
+			attempts = int(n) + 1
+		}
+		req.Ctx.Put(key, attempts)
+		rewindBody(req)
+		if attempts <= p.maxRetries && p.retryable(r.StatusCode) {
+			d := p.backoff * time.Duration(1<<(attempts-1))
+			Log.Debug(fmt.Sprintf("任务【%s-%s】请求失败,%s后第%d次重试: %s, err:%s", t.tongs.Name, t.Name, d, attempts, req.URL.String(), err.Error()))
+			if rerr := t.retryRequest(req, d); rerr == nil {
+				return
+			} else {
+				Log.Error(fmt.Sprintf("任务【%s-%s】请求重试失败: %s, err:%s", t.tongs.Name, t.Name, req.URL.String(), rerr.Error()))
+			}
+		}
+		if dead == nil {
+			return
+		}
+		//重放时重新计算重试次数
+		req.Ctx.Put(key, 0)
+		raw, merr := marshalRequest(req, nil)
+		if merr != nil {
+			Log.Error(fmt.Sprintf("任务【%s-%s】请求序列化失败: %s, err:%s", t.tongs.Name, t.Name, req.URL.String(), merr.Error()))
+			return
+		}
+		d := &DeadLetter{
+			ID:         t.deadLetterID(raw),
+			URL:        req.URL.String(),
+			Method:     req.Method,
+			Error:      err.Error(),
+			StatusCode: r.StatusCode,
+			Attempts:   attempts,
+			FailedAt:   time.Now().Unix(),
+			Request:    raw,
+		}
+		if err := dead.AddDeadLetter(d); err != nil {
+			Log.Error(fmt.Sprintf("任务【%s-%s】写入死信失败: %s, err:%s", t.tongs.Name, t.Name, req.URL.String(), err.Error()))
+			return
+		}
+		Log.Warn(fmt.Sprintf("任务【%s-%s】请求失败%d次,已写入死信: %s", t.tongs.Name, t.Name, attempts, req.URL.String()))
+	})
+}
+
+func newRetryPolicy(c config.Retry) *retryPolicy {
+	return &retryPolicy{maxRetries: c.MaxRetries, backoff: time.Duration(c.Backoff) * time.Second, status: c.Status}
+}
+
+// retryable 未配置状态码时所有错误都重试,网络错误的状态码为0
+func (p *retryPolicy) retryable(status int) bool {
+	if len(p.status) == 0 {
+		return true
+	}
+	for _, s := range p.status {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Task) retryRequest(r *colly.Request, d time.Duration) error {
+	if t.IsQueue {
+		return t.queue.AddRequestAt(r, time.Now().Add(d))
+	}
+	//暂停时重试请求在发出前等待,停止时等待中的重试被取消
+	t.retries.after(d, func() {
+		if err := r.Retry(); err != nil {
+			Log.Debug(fmt.Sprintf("任务【%s-%s】请求重试未发出: %s, err:%s", t.tongs.Name, t.Name, r.URL.String(), err.Error()))
+		}
+	})
+	return nil
+}
+
+// retryTimers 普通任务等待中的重试
+type retryTimers struct {
+	mu      sync.Mutex
+	timers  map[*time.Timer]struct{} //还没有到期的重试
+	n       int                      //还没有执行完成的重试
+	pending sync.WaitGroup
+}
+
+// after d之后执行重试
+func (p *retryTimers) after(d time.Duration, fn func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.timers == nil {
+		p.timers = make(map[*time.Timer]struct{})
+	}
+	p.n++
+	p.pending.Add(1)
+	var timer *time.Timer
+	timer = time.AfterFunc(d, func() {
+		p.mu.Lock()
+		delete(p.timers, timer)
+		p.mu.Unlock()
+		fn()
+		p.mu.Lock()
+		p.n--
+		p.mu.Unlock()
+		p.pending.Done()
+	})
+	p.timers[timer] = struct{}{}
+}
+
+// cancel 取消所有还没有到期的重试
+func (p *retryTimers) cancel() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for timer := range p.timers {
+		if timer.Stop() {
+			p.n--
+			p.pending.Done()
+		}
+		delete(p.timers, timer)
+	}
+}
+
+// wait 等待所有重试执行完成,返回是否有等待中的重试
+func (p *retryTimers) wait() bool {
+	p.mu.Lock()
+	n := p.n
+	p.mu.Unlock()
+	if n == 0 {
+		return false
+	}
+	p.pending.Wait()
+	return true
+}
+
+// DeadLetters 获取死信及总数
+func (t *Task) DeadLetters(offset, n int) ([]*DeadLetter, int, error) {
+	s, err := t.deadLetterStore()
+	if err != nil {
+		return nil, 0, err
+	}
+	total, err := s.DeadLetterSize()
+	if err != nil {
+		return nil, 0, err
+	}
+	letters, err := s.DeadLetters(offset, n)
+	return letters, total, err
+}
+
+// ReplayDeadLetters 将死信重新加入任务,ids为空时重放全部,返回重放的数量
+// 队列任务直接入队不做去重,普通任务立即重新请求
+func (t *Task) ReplayDeadLetters(ids ...string) (int, error) {
+	s, err := t.deadLetterStore()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		letters, err := s.DeadLetters(0, -1)
+		if err != nil {
+			return 0, err
+		}
+		for _, d := range letters {
+			ids = append(ids, d.ID)
+		}
+	}
+	replayed := 0
+	for _, id := range ids {
+		d, err := s.RemoveDeadLetter(id)
+		if err != nil {
+			return replayed, err
+		}
+		if d == nil {
+			continue
+		}
+		if err := t.replay(d); err != nil {
+			if aerr := s.AddDeadLetter(d); aerr != nil {
+				Log.Error(fmt.Sprintf("任务【%s-%s】死信放回失败: %s, err:%s", t.tongs.Name, t.Name, d.URL, aerr.Error()))
+			}
+			return replayed, err
+		}
+		replayed++
+	}
+	Log.Info(fmt.Sprintf("任务【%s-%s】重放死信%d个", t.tongs.Name, t.Name, replayed))
+	return replayed, nil
+}
+
+func (t *Task) replay(d *DeadLetter) error {
+	if t.IsQueue {
+		s, err := t.inspectStore()
+		if err != nil {
+			return err
+		}
+		if err := s.PushRequest(d.Request); err != nil {
+			return err
+		}
+		t.queue.notify()
+		return nil
+	}
+	r, err := t.collector.UnmarshalRequest(d.Request)
+	if err != nil {
+		return err
+	}
+	//和等待中的重试一样计入运行中的请求,运行在重放完成后才结束
+	t.retries.after(0, func() {
+		if err := r.Retry(); err != nil {
+			Log.Error(fmt.Sprintf("任务【%s-%s】死信重放失败: %s, err:%s", t.tongs.Name, t.Name, d.URL, err.Error()))
+		}
+	})
+	return nil
+}
+
+// PurgeDeadLetters 清空死信
+func (t *Task) PurgeDeadLetters() (int, error) {
+	s, err := t.deadLetterStore()
+	if err != nil {
+		return 0, err
+	}
+	n, err := s.PurgeDeadLetters()
+	if err == nil {
+		Log.Info(fmt.Sprintf("任务【%s-%s】清空死信%d个", t.tongs.Name, t.Name, n))
+	}
+	return n, err
+}
+
+func (t *Task) deadLetterStore() (DeadLetterStore, error) {
+	s, ok := t.store.(DeadLetterStore)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("任务【%s】的存储器不支持死信队列", t.Name))
+	}
+	return s, nil
+}
+
+func attemptKey(r *colly.Request) string {
+	return AttemptKey + ":" + r.URL.String()
+}
+
+// rewindBody 请求体已在发送时读取,重试和序列化前需要回到开头
+func rewindBody(r *colly.Request) {
+	if s, ok := r.Body.(io.Seeker); ok {
+		s.Seek(0, io.SeekStart)
+	}
+}
+
+// deadLetterID 使用任务的请求指纹作为死信ID,同一请求多次失败时覆盖
+// 不去重的请求按方法、url和请求体区分,避免同一url不同请求体的POST请求互相覆盖
+func (t *Task) deadLetterID(raw []byte) string {
+	r, err := parseRequest(raw)
+	if err != nil {
+		h := fnv.New64a()
+		h.Write(raw)
+		return strconv.FormatUint(h.Sum64(), 16)
+	}
+	if fp, dedupe := fingerprint(t.fingerprinter, r); dedupe {
+		return strconv.FormatUint(fp, 16)
+	}
+	h := fnv.New64a()
+	h.Write([]byte(r.Method + " " + r.URL + "\n"))
+	h.Write(r.Body)
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+func sortDeadLetters(letters []*DeadLetter) {
+	sort.Slice(letters, func(i, j int) bool {
+		if letters[i].FailedAt != letters[j].FailedAt {
+			return letters[i].FailedAt > letters[j].FailedAt
+		}
+		return letters[i].ID < letters[j].ID
+	})
+}
+
+func deadLetterKey(id string) string {
+	return fmt.Sprintf("%s:dead", id)
+}
+
+func deadLetterIndexKey(id string) string {
+	return fmt.Sprintf("%s:dead:index", id)
+}
+
+// redis中死信内容保存在 <id>:dead 哈希中,<id>:dead:index 有序集合按失败时间排序
+func redisAddDeadLetter(c redis.UniversalClient, id string, d *DeadLetter) error {
+	bys, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	_, err = c.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(deadLetterKey(id), d.ID, string(bys))
+		pipe.ZAdd(deadLetterIndexKey(id), redis.Z{Score: float64(d.FailedAt), Member: d.ID})
+		return nil
+	})
+	return err
+}
+
+func redisDeadLetters(c redis.UniversalClient, id string, offset, n int) ([]*DeadLetter, error) {
+	stop := int64(offset + n - 1)
+	if n < 0 {
+		stop = -1
+	}
+	ids, err := c.ZRevRange(deadLetterIndexKey(id), int64(offset), stop).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	values, err := c.HMGet(deadLetterKey(id), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	letters := make([]*DeadLetter, 0, len(values))
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		d := &DeadLetter{}
+		if err := json.Unmarshal([]byte(s), d); err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	return letters, nil
+}
+
+func redisDeadLetterSize(c redis.UniversalClient, id string) (int, error) {
+	n, err := c.ZCard(deadLetterIndexKey(id)).Result()
+	return int(n), err
+}
+
+func redisRemoveDeadLetter(c redis.UniversalClient, id, letter string) (*DeadLetter, error) {
+	var get *redis.StringCmd
+	var del *redis.IntCmd
+	_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+		get = pipe.HGet(deadLetterKey(id), letter)
+		del = pipe.HDel(deadLetterKey(id), letter)
+		pipe.ZRem(deadLetterIndexKey(id), letter)
+		return nil
+	})
+	if err == redis.Nil || (err == nil && del.Val() == 0) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	d := &DeadLetter{}
+	if err := json.Unmarshal([]byte(get.Val()), d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func redisPurgeDeadLetters(c redis.UniversalClient, id string) (int, error) {
+	n, err := c.ZCard(deadLetterIndexKey(id)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), c.Del(deadLetterKey(id), deadLetterIndexKey(id)).Err()
+}
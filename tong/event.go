@@ -0,0 +1,66 @@
+package tong
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	EventFinished = "finished" //执行完成
+	EventFailed   = "failed"   //执行失败
+	EventStopped  = "stopped"  //被手动停止
+)
+
+// TaskEvent 任务一次运行结束的事件
+type TaskEvent struct {
+	Tongs string    `json:"tongs"`
+	Task  string    `json:"task"`
+	Type  string    `json:"type"`
+	Error string    `json:"error,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+var (
+	eventListeners   []func(e *TaskEvent)
+	eventListenersMu sync.RWMutex
+)
+
+// OnTaskEvent 监听所有任务的运行结束事件,回调在单独的协程中执行
+func OnTaskEvent(fn func(e *TaskEvent)) {
+	eventListenersMu.Lock()
+	defer eventListenersMu.Unlock()
+	eventListeners = append(eventListeners, fn)
+}
+
+// OnComplete 监听当前任务的运行结束事件,回调在单独的协程中执行
+func (t *Task) OnComplete(fn func(e *TaskEvent)) *Task {
+	t.listeners = append(t.listeners, fn)
+	return t
+}
+
+// complete 任务运行结束,被停止的任务即使出错也视为停止
+func (t *Task) complete(stopped bool, err error) {
+	e := &TaskEvent{Tongs: t.tongs.Name, Task: t.Name, Type: EventFinished, At: time.Now()}
+	if stopped {
+		e.Type = EventStopped
+	} else if err != nil {
+		e.Type = EventFailed
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	Log.Debug(fmt.Sprintf("任务【%s-%s】运行结束【%s】", t.tongs.Name, t.Name, e.Type))
+	eventListenersMu.RLock()
+	listeners := append(append([]func(e *TaskEvent){}, eventListeners...), t.listeners...)
+	eventListenersMu.RUnlock()
+	run := t.finishRun(e)
+	go func() {
+		saveRun(run)
+		runs.Done()
+		t.tongs.graph.onComplete(t, e)
+		for _, fn := range listeners {
+			fn(e)
+		}
+	}()
+}
@@ -0,0 +1,491 @@
+package tong
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotName       = "snapshot.json"
+	segmentPattern     = "journal-%08d.log"
+	segmentSizeDefault = 64 //单个日志分段默认大小,单位MB
+	recordHeaderSize   = 8  //日志记录头: 4字节长度 + 4字节crc32
+
+	//快照格式版本,修改快照格式时增加版本并在migrateSnapshot中兼容旧版本
+	//未记录版本的旧快照: 队列为列表或优先级队列,访问记录为不带访问时间的集合
+	snapshotVersion = 1
+)
+
+var (
+	fileDBs   = make(map[string]*memoryDB)
+	fileDBsMu sync.Mutex
+)
+
+// FileStore 基于本地文件的持久化存储器,单机部署时无需redis,进程重启后从中断处继续执行队列
+// 所有修改以追加方式写入分段日志,日志分段写满后生成快照并删除旧分段
+type FileStore struct {
+	MemoryStore
+	Dir string //数据目录,同一目录下的任务共用一份数据,与共用一个redis相同
+}
+
+// Init 打开数据目录并恢复快照和日志
+func (s *FileStore) Init() error {
+	if s.Dir == "" {
+		return errors.New(fmt.Sprintf("【%s】未设置存储目录", s.Id))
+	}
+	//打开和关闭在同一把锁内,避免取到正在关闭的存储空间
+	fileDBsMu.Lock()
+	defer fileDBsMu.Unlock()
+	if s.db == nil {
+		db, err := openFileDB(s.Dir)
+		if err != nil {
+			return err
+		}
+		s.db = db
+	}
+	return s.MemoryStore.Init()
+}
+
+// Close 关闭存储器,同一目录的存储器全部关闭后关闭日志文件,再次打开时从快照和日志恢复
+func (s *FileStore) Close() error {
+	fileDBsMu.Lock()
+	defer fileDBsMu.Unlock()
+	if !s.release() {
+		return nil
+	}
+	j := s.db.journal
+	delete(fileDBs, j.dir)
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return j.file.Close()
+}
+
+// fileSnapshot 快照内容,Segment之前的日志分段已全部包含在快照中
+type fileSnapshot struct {
+	Version  int                              `json:"version"`
+	Segment  int                              `json:"segment"`
+	Seq      uint64                           `json:"seq"` //最后分配的入队序号
+	Queues   map[string][]*memoryQueueItem    `json:"queues"`
+	Inflight map[string][]*memoryInflightItem `json:"inflight"`
+	Delayed  map[string][]*memoryDelayedItem  `json:"delayed"`
+	Sets     map[string]map[uint64]int64      `json:"sets"`
+	Hashes   map[string]map[string]string     `json:"hashes"`
+}
+
+// legacySnapshot 未记录版本的旧快照
+type legacySnapshot struct {
+	Segment  int                              `json:"segment"`
+	Lists    map[string][][]byte              `json:"lists"`
+	Queues   map[string][]*memoryQueueItem    `json:"queues"`
+	Inflight map[string][]*memoryInflightItem `json:"inflight"`
+	Delayed  map[string][]*memoryDelayedItem  `json:"delayed"`
+	Sets     map[string][]uint64              `json:"sets"`
+	Hashes   map[string]map[string]string     `json:"hashes"`
+}
+
+// fileJournal memoryDB的追加写日志
+type fileJournal struct {
+	dir         string
+	db          *memoryDB
+	file        *os.File
+	segment     int
+	size        int64
+	segmentSize int64
+	sync        bool
+}
+
+// openFileDB 打开目录对应的存储空间,同一目录在进程内只打开一次,调用方需持有fileDBsMu
+func openFileDB(dir string) (*memoryDB, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if db, ok := fileDBs[dir]; ok {
+		return db, nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	db := newMemoryDB()
+	j := &fileJournal{
+		dir:         dir,
+		db:          db,
+		segmentSize: int64(segmentSizeDefault) << 20,
+		sync:        Config.Store.Sync,
+	}
+	if Config.Store.SegmentSize > 0 {
+		j.segmentSize = int64(Config.Store.SegmentSize) << 20
+	}
+	if err := j.recover(); err != nil {
+		return nil, err
+	}
+	db.journal = j
+	if err := j.reclaimAll(); err != nil {
+		return nil, err
+	}
+	fileDBs[dir] = db
+	return db, nil
+}
+
+// recover 加载快照并重放快照之后的日志分段,分段末尾写了一半的记录会被截断
+// 写入失败后会切换到新分段,所以除最后一个分段外也可能有写了一半的记录
+func (j *fileJournal) recover() error {
+	snapshot, err := j.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	segments, err := j.segments()
+	if err != nil {
+		return err
+	}
+	j.segment = snapshot.Segment
+	for _, segment := range segments {
+		path := j.segmentPath(segment)
+		if segment < snapshot.Segment {
+			//快照已生成但旧分段还未删除
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			continue
+		}
+		size, err := j.replay(path)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if info.Size() > size {
+			Log.Warn(fmt.Sprintf("日志分段【%s】末尾有%d字节不完整的记录,已截断", path, info.Size()-size))
+			if err := os.Truncate(path, size); err != nil {
+				return err
+			}
+		}
+		j.segment = segment
+		j.size = size
+	}
+	return j.openSegment()
+}
+
+// reclaimAll 数据目录只被一个进程使用,启动时处理中的请求都是上次退出前未处理完的,全部放回队列
+func (j *fileJournal) reclaimAll() error {
+	for key := range j.db.inflight {
+		queue := strings.TrimSuffix(key, ":inflight") + ":queue"
+		if err := j.db.apply(memoryOp{Op: opReclaim, Key: key, Field: queue, Time: math.MaxInt64}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *fileJournal) loadSnapshot() (*fileSnapshot, error) {
+	snapshot := &fileSnapshot{Version: snapshotVersion}
+	bys, err := os.ReadFile(filepath.Join(j.dir, snapshotName))
+	if os.IsNotExist(err) {
+		return snapshot, nil
+	} else if err != nil {
+		return nil, err
+	}
+	version := &struct {
+		Version int `json:"version"`
+	}{}
+	if err := json.Unmarshal(bys, version); err != nil {
+		return nil, errors.New(fmt.Sprintf("快照文件损坏: %s", err.Error()))
+	}
+	switch {
+	case version.Version == 0:
+		if snapshot, err = migrateSnapshot(bys); err != nil {
+			return nil, err
+		}
+		Log.Warn(fmt.Sprintf("数据目录【%s】的快照为旧版本,已转换为版本%d", j.dir, snapshotVersion))
+	case version.Version > snapshotVersion:
+		return nil, errors.New(fmt.Sprintf("快照文件版本【%d】高于当前支持的版本【%d】", version.Version, snapshotVersion))
+	default:
+		if err := json.Unmarshal(bys, snapshot); err != nil {
+			return nil, errors.New(fmt.Sprintf("快照文件损坏: %s", err.Error()))
+		}
+	}
+	j.restoreSeq(snapshot)
+	for k, items := range snapshot.Queues {
+		for _, item := range items {
+			j.db.pushItem(k, item)
+		}
+	}
+	for k, items := range snapshot.Inflight {
+		inflight := make(map[string]*memoryInflightItem, len(items))
+		for _, item := range items {
+			inflight[string(item.Value)] = item
+		}
+		j.db.inflight[k] = inflight
+	}
+	for k, items := range snapshot.Delayed {
+		j.db.delayed[k] = items
+	}
+	for k, v := range snapshot.Sets {
+		j.db.sets[k] = v
+	}
+	for k, v := range snapshot.Hashes {
+		j.db.hashes[k] = v
+	}
+	return snapshot, nil
+}
+
+// restoreSeq 恢复入队序号,之后入队和日志中重放的请求从快照的序号继续编号,不会与处理中的请求重复
+// 旧快照没有记录序号,按已有请求的最大序号继续编号,队列中没有序号的请求按快照中的顺序重新编号
+func (j *fileJournal) restoreSeq(snapshot *fileSnapshot) {
+	j.db.seq = snapshot.Seq
+	for _, items := range snapshot.Inflight {
+		for _, item := range items {
+			if item.Seq > j.db.seq {
+				j.db.seq = item.Seq
+			}
+		}
+	}
+	for _, items := range snapshot.Queues {
+		for _, item := range items {
+			if item.Seq > j.db.seq {
+				j.db.seq = item.Seq
+			}
+		}
+	}
+	for _, items := range snapshot.Queues {
+		for _, item := range items {
+			if item.Seq == 0 {
+				j.db.seq++
+				item.Seq = j.db.seq
+			}
+		}
+	}
+}
+
+// migrateSnapshot 转换未记录版本的旧快照
+// 列表按顺序转为默认优先级的队列,访问记录没有访问时间,按加载时间记录,设置了有效期时在一个有效期后过期
+func migrateSnapshot(bys []byte) (*fileSnapshot, error) {
+	legacy := &legacySnapshot{}
+	if err := json.Unmarshal(bys, legacy); err != nil {
+		return nil, errors.New(fmt.Sprintf("快照文件损坏: %s", err.Error()))
+	}
+	snapshot := &fileSnapshot{
+		Version:  snapshotVersion,
+		Segment:  legacy.Segment,
+		Queues:   legacy.Queues,
+		Inflight: legacy.Inflight,
+		Delayed:  legacy.Delayed,
+		Sets:     make(map[string]map[uint64]int64, len(legacy.Sets)),
+		Hashes:   legacy.Hashes,
+	}
+	if snapshot.Queues == nil {
+		snapshot.Queues = make(map[string][]*memoryQueueItem, len(legacy.Lists))
+	}
+	for k, list := range legacy.Lists {
+		for _, value := range list {
+			snapshot.Queues[k] = append(snapshot.Queues[k], &memoryQueueItem{Value: value})
+		}
+	}
+	now := time.Now().UnixMilli()
+	for k, members := range legacy.Sets {
+		set := make(map[uint64]int64, len(members))
+		for _, member := range members {
+			set[member] = now
+		}
+		snapshot.Sets[k] = set
+	}
+	return snapshot, nil
+}
+
+// replay 重放一个分段,返回最后一条完整记录的结束位置
+func (j *fileJournal) replay(path string) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			return offset, nil
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, nil
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return offset, nil
+		}
+		var ops []memoryOp
+		if err := json.Unmarshal(payload, &ops); err != nil {
+			return offset, nil
+		}
+		for _, op := range ops {
+			if op.Op == opSAdd && op.Time == 0 {
+				//旧版本日志中的访问记录没有访问时间
+				op.Time = time.Now().UnixMilli()
+			}
+			j.db.exec(op)
+		}
+		offset += int64(recordHeaderSize) + int64(length)
+	}
+}
+
+func (j *fileJournal) segments() ([]int, error) {
+	paths, err := filepath.Glob(filepath.Join(j.dir, "journal-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	segments := make([]int, 0, len(paths))
+	for _, path := range paths {
+		var segment int
+		if _, err := fmt.Sscanf(filepath.Base(path), segmentPattern, &segment); err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+func (j *fileJournal) segmentPath(segment int) string {
+	return filepath.Join(j.dir, fmt.Sprintf(segmentPattern, segment))
+}
+
+func (j *fileJournal) openSegment() error {
+	f, err := os.OpenFile(j.segmentPath(j.segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.file = f
+	return nil
+}
+
+// write 写入一条记录,调用方持有memoryDB的写锁
+// 写入失败时截断写了一半的记录,截断失败则切换到新分段,避免之后的记录追加在不完整的记录之后
+func (j *fileJournal) write(ops []memoryOp) error {
+	if j.size >= j.segmentSize {
+		if err := j.rotate(); err != nil {
+			return err
+		}
+	}
+	payload, err := json.Marshal(ops)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[recordHeaderSize:], payload)
+	if _, err := j.file.Write(record); err != nil {
+		j.discard()
+		return err
+	}
+	if j.sync {
+		if err := j.file.Sync(); err != nil {
+			j.discard()
+			return err
+		}
+	}
+	j.size += int64(len(record))
+	return nil
+}
+
+// discard 丢弃写入失败的记录,截断到最后一条完整记录的结束位置
+func (j *fileJournal) discard() {
+	err := j.file.Truncate(j.size)
+	if err == nil {
+		return
+	}
+	Log.Error(fmt.Sprintf("日志分段【%s】截断失败,切换到新分段, err:%s", j.file.Name(), err.Error()))
+	j.file.Close()
+	j.segment++
+	j.size = 0
+	if err := j.openSegment(); err != nil {
+		Log.Error(fmt.Sprintf("打开日志分段【%s】失败, err:%s", j.segmentPath(j.segment), err.Error()))
+	}
+}
+
+// rotate 将当前内存状态写入快照,切换到新分段并删除旧分段
+func (j *fileJournal) rotate() error {
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	old := j.segment
+	j.segment++
+	j.size = 0
+	if err := j.writeSnapshot(); err != nil {
+		return err
+	}
+	if err := j.openSegment(); err != nil {
+		return err
+	}
+	for segment := old; segment >= 0; segment-- {
+		if err := os.Remove(j.segmentPath(segment)); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (j *fileJournal) writeSnapshot() error {
+	j.db.sweep(time.Now())
+	snapshot := &fileSnapshot{
+		Version:  snapshotVersion,
+		Segment:  j.segment,
+		Seq:      j.db.seq,
+		Queues:   make(map[string][]*memoryQueueItem, len(j.db.queues)),
+		Inflight: make(map[string][]*memoryInflightItem, len(j.db.inflight)),
+		Delayed:  j.db.delayed,
+		Sets:     j.db.sets,
+		Hashes:   j.db.hashes,
+	}
+	for k, q := range j.db.queues {
+		snapshot.Queues[k] = q.items()
+	}
+	for k, inflight := range j.db.inflight {
+		items := make([]*memoryInflightItem, 0, len(inflight))
+		for _, item := range inflight {
+			items = append(items, item)
+		}
+		snapshot.Inflight[k] = items
+	}
+	bys, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(j.dir, snapshotName+".tmp")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bys); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(j.dir, snapshotName))
+}
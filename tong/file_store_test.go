@@ -0,0 +1,189 @@
+package tong
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// openTestFileStore 打开数据目录,关闭后再次打开同一目录时模拟进程重启,从快照和日志恢复
+func openTestFileStore(t *testing.T, dir string) *FileStore {
+	t.Helper()
+	s := &FileStore{MemoryStore: MemoryStore{Id: "test:task", TongsName: "test", IsQueue: true}, Dir: dir}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// reopenTestFileStore 关闭存储器后重新打开
+func reopenTestFileStore(t *testing.T, s *FileStore) *FileStore {
+	t.Helper()
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openTestFileStore(t, s.Dir)
+}
+
+func addTestRequests(t *testing.T, s *FileStore, urls ...string) {
+	t.Helper()
+	for _, u := range urls {
+		if err := s.AddRequest(testRequest(u, 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "journal-*.log"))
+	if err != nil || len(paths) == 0 {
+		t.Fatalf("没有日志分段: %v", err)
+	}
+	return paths[len(paths)-1]
+}
+
+func TestFileStoreRecover(t *testing.T) {
+	cases := []struct {
+		name     string
+		corrupt  func(t *testing.T, path string)
+		lostLast bool //最后一条完整写入的记录是否被丢弃
+	}{
+		{"末尾记录不完整", func(t *testing.T, path string) {
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			//记录头声明的长度大于实际写入的内容
+			if _, err := f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '[', '{'}); err != nil {
+				t.Fatal(err)
+			}
+		}, false},
+		{"末尾记录crc错误", func(t *testing.T, path string) {
+			bys, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			bys[len(bys)-2] ^= 0xff
+			if err := os.WriteFile(path, bys, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openTestFileStore(t, dir)
+			addTestRequests(t, s, "http://example.com/a", "http://example.com/b")
+			good := fileSize(t, lastSegment(t, dir))
+			addTestRequests(t, s, "http://example.com/c")
+			want := []string{"http://example.com/a", "http://example.com/b"}
+			if !c.lostLast {
+				good = fileSize(t, lastSegment(t, dir))
+				want = append(want, "http://example.com/c")
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			c.corrupt(t, lastSegment(t, dir))
+
+			s = openTestFileStore(t, dir)
+			if size := fileSize(t, lastSegment(t, dir)); size != good {
+				t.Fatalf("恢复后分段大小 %d, want %d", size, good)
+			}
+			//截断后追加的记录在下次恢复时可以读取
+			addTestRequests(t, s, "http://example.com/d")
+			want = append(want, "http://example.com/d")
+			s = reopenTestFileStore(t, s)
+			if got := popAll(t, &s.MemoryStore); !equalURLs(got, want) {
+				t.Fatalf("恢复后队列 %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Size()
+}
+
+func TestFileStoreSnapshotVersion(t *testing.T) {
+	cases := []struct {
+		name      string
+		snapshot  interface{}
+		wantErr   bool
+		wantQueue []string
+		visited   uint64
+	}{
+		{"旧版本快照", map[string]interface{}{
+			"segment": 0,
+			"lists": map[string][][]byte{
+				"test:task:queue": {testRequest("http://example.com/a", 1), testRequest("http://example.com/b", 1)},
+			},
+			"sets": map[string][]uint64{"test:visited": {42}},
+		}, false, []string{"http://example.com/a", "http://example.com/b"}, 42},
+		{"高于当前版本", map[string]interface{}{"version": snapshotVersion + 1}, true, nil, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dir := t.TempDir()
+			bys, err := json.Marshal(c.snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(dir, snapshotName), bys, 0644); err != nil {
+				t.Fatal(err)
+			}
+			s := &FileStore{MemoryStore: MemoryStore{Id: "test:task", TongsName: "test", IsQueue: true}, Dir: dir}
+			err = s.Init()
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("应拒绝高版本快照")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { s.Close() })
+			if visited, _ := s.IsVisited(c.visited); !visited {
+				t.Fatalf("访问记录%d未恢复", c.visited)
+			}
+			if got := popAll(t, &s.MemoryStore); !equalURLs(got, c.wantQueue) {
+				t.Fatalf("恢复后队列 %v, want %v", got, c.wantQueue)
+			}
+		})
+	}
+}
+
+// TestFileStoreSnapshotSeq 快照后重启,放回的处理中请求与队列中的请求保持原来的顺序
+func TestFileStoreSnapshotSeq(t *testing.T) {
+	dir := t.TempDir()
+	s := openTestFileStore(t, dir)
+	addTestRequests(t, s, "http://example.com/a", "http://example.com/b", "http://example.com/c")
+	for i := 0; i < 2; i++ {
+		if _, err := s.GetRequest(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.db.mu.Lock()
+	err := s.db.journal.rotate()
+	s.db.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = reopenTestFileStore(t, s)
+	addTestRequests(t, s, "http://example.com/d")
+	want := []string{"http://example.com/a", "http://example.com/b", "http://example.com/c", "http://example.com/d"}
+	if got := popAll(t, &s.MemoryStore); !equalURLs(got, want) {
+		t.Fatalf("重启后队列 %v, want %v", got, want)
+	}
+}
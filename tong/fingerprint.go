@@ -0,0 +1,176 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"tongs/config"
+
+	"github.com/gocolly/colly/v2"
+	whatwgUrl "github.com/nlnwa/whatwg-url/url"
+)
+
+// RequestFingerprinter 计算请求的指纹,队列任务在存储器入队时使用指纹去重,普通任务在发出请求前使用指纹去重
+type RequestFingerprinter interface {
+	// Fingerprint 返回请求指纹,dedupe为false时该请求不去重
+	Fingerprint(r *QueuedRequest) (fp uint64, dedupe bool)
+}
+
+// Fingerprinter 内置的请求指纹
+// 不开启任何选项时只对GET请求去重,指纹与colly计算的请求ID一致
+type Fingerprinter struct {
+	Method     bool             //指纹包含请求方法
+	Body       bool             //指纹包含请求体,开启后非GET请求也会去重
+	Headers    []string         //参与计算指纹的请求头
+	DropParams []*regexp.Regexp //名称匹配的query参数不参与计算指纹,如跟踪参数utm_.*
+	SortParams bool             //query参数排序后计算指纹
+}
+
+// VisitStore 支持原子记录访问的存储器,普通任务多线程请求同一个指纹时只有一个请求不被去重
+type VisitStore interface {
+	// Visit 记录访问,返回记录前是否已访问过
+	Visit(requestID uint64) (bool, error)
+}
+
+// defaultFingerprinter 未配置指纹时使用
+var defaultFingerprinter = &Fingerprinter{}
+
+// NewFingerprinter 根据配置创建请求指纹
+func NewFingerprinter(c config.Fingerprint) (*Fingerprinter, error) {
+	f := &Fingerprinter{
+		Method:     c.Method,
+		Body:       c.Body,
+		SortParams: c.SortParams,
+	}
+	for _, h := range c.Headers {
+		f.Headers = append(f.Headers, http.CanonicalHeaderKey(h))
+	}
+	for _, p := range c.DropParams {
+		re, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("去重参数规则【%s】错误: %s", p, err.Error()))
+		}
+		f.DropParams = append(f.DropParams, re)
+	}
+	return f, nil
+}
+
+// Fingerprint implements RequestFingerprinter
+func (f *Fingerprinter) Fingerprint(r *QueuedRequest) (uint64, bool) {
+	if r.Method != "GET" && !f.Body {
+		return 0, false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(f.normalizeURL(r.URL)))
+	if f.Method {
+		h.Write([]byte("\n" + r.Method))
+	}
+	for _, name := range f.Headers {
+		h.Write([]byte("\n" + name + ":" + strings.Join(r.Headers.Values(name), ",")))
+	}
+	if f.Body && len(r.Body) > 0 {
+		h.Write([]byte("\n"))
+		h.Write(r.Body)
+	}
+	return h.Sum64(), true
+}
+
+// normalizeURL 与colly相同,使用whatwg规则重新解析url以消除 "http://a.com" 与 "http://a.com/" 这类差异
+func (f *Fingerprinter) normalizeURL(rawURL string) string {
+	normalized := rawURL
+	if u, err := whatwgUrl.Parse(rawURL); err == nil {
+		normalized = u.String()
+	}
+	if len(f.DropParams) == 0 && !f.SortParams {
+		return normalized
+	}
+	u, err := url.Parse(normalized)
+	if err != nil || u.RawQuery == "" {
+		return normalized
+	}
+	params := strings.Split(u.RawQuery, "&")
+	kept := params[:0]
+	for _, p := range params {
+		name := p
+		if i := strings.Index(p, "="); i >= 0 {
+			name = p[:i]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !f.dropParam(name) {
+			kept = append(kept, p)
+		}
+	}
+	if f.SortParams {
+		sort.Strings(kept)
+	}
+	u.RawQuery = strings.Join(kept, "&")
+	return u.String()
+}
+
+func (f *Fingerprinter) dropParam(name string) bool {
+	for _, re := range f.DropParams {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprint 计算请求指纹,未设置指纹时使用默认指纹
+func fingerprint(f RequestFingerprinter, r *QueuedRequest) (uint64, bool) {
+	if f == nil {
+		f = defaultFingerprinter
+	}
+	return f.Fingerprint(r)
+}
+
+// visited 普通任务按请求指纹判断请求是否访问过,未访问过时记录访问
+// 重试和重放死信的请求上下文中有重试次数,不去重
+func (t *Task) visited(r *colly.Request) bool {
+	if !t.visitCheck || r.Ctx.GetAny(attemptKey(r)) != nil {
+		return false
+	}
+	fp, dedupe := fingerprint(t.fingerprinter, requestOf(r))
+	if !dedupe {
+		return false
+	}
+	visited, err := recordVisit(t.store, fp)
+	if err != nil {
+		Log.Error(fmt.Sprintf("任务【%s-%s】记录访问失败: %s, err:%s", t.tongs.Name, t.Name, r.URL.String(), err.Error()))
+		return false
+	}
+	return visited
+}
+
+// recordVisit 记录访问并返回之前是否已访问过,存储器不支持VisitStore时先判断再记录,并发请求同一个指纹时可能都未去重
+func recordVisit(s Store, fp uint64) (bool, error) {
+	if vs, ok := s.(VisitStore); ok {
+		return vs.Visit(fp)
+	}
+	visited, err := s.IsVisited(fp)
+	if err != nil || visited {
+		return visited, err
+	}
+	return false, s.Visited(fp)
+}
+
+// requestOf 将colly请求转换为计算指纹的请求,可以回到开头的请求体读取后回到开头
+func requestOf(r *colly.Request) *QueuedRequest {
+	req := &QueuedRequest{URL: r.URL.String(), Method: r.Method, Depth: r.Depth}
+	if r.Headers != nil {
+		req.Headers = *r.Headers
+	}
+	if s, ok := r.Body.(io.ReadSeeker); ok {
+		req.Body, _ = io.ReadAll(s)
+		s.Seek(0, io.SeekStart)
+	}
+	return req
+}
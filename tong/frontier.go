@@ -0,0 +1,361 @@
+package tong
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// 导出文件为gzip压缩的json lines,第一行为文件头,之后每行一条记录
+// 导出和导入的内容使用ResetOption表示: 队列、访问记录、cookie
+const frontierVersion = 1
+
+// frontierBatchSize 导入时每批写入存储器的记录数量
+const frontierBatchSize = 500
+
+const (
+	recordRequest        = "request"         //队列中的请求,处理中的请求也作为普通请求导出
+	recordDelayed        = "delayed"         //延迟请求,Time为到期时间
+	recordVisited        = "visited"         //访问记录,Time为访问时间
+	recordBloom          = "bloom"           //布隆过滤器分块,Key为过滤器后缀,Field为过滤器实现,Iter为分块位置
+	recordCookie         = "cookie"          //cookie,Key为host
+	recordIdentity       = "identity"        //账号,Data为账号信息
+	recordIdentityCookie = "identity-cookie" //账号cookie,Key为账号名称,Field为host
+)
+
+// FrontierRecord 导出文件中的一条记录
+type FrontierRecord struct {
+	Task   string `json:"task,omitempty"` //所属任务,Tongs内共用的访问记录和cookie为空
+	Type   string `json:"type"`
+	Key    string `json:"key,omitempty"`
+	Field  string `json:"field,omitempty"`
+	Member uint64 `json:"member,omitempty"`
+	Time   int64  `json:"time,omitempty"`
+	Iter   int64  `json:"iter,omitempty"`
+	Data   []byte `json:"data,omitempty"`
+}
+
+// frontierHeader 导出文件头
+type frontierHeader struct {
+	Version    int    `json:"version"`
+	Tongs      string `json:"tongs"`
+	Task       string `json:"task,omitempty"`
+	ExportedAt int64  `json:"exportedAt"`
+}
+
+// ExportStore 支持导出和导入的存储器
+type ExportStore interface {
+	// Export 按opt导出队列、访问记录或cookie,每条记录调用一次fn
+	Export(opt ResetOption, fn func(rec *FrontierRecord) error) error
+	// Import 导入一批记录,队列中的请求直接入队不做去重
+	Import(recs []*FrontierRecord) error
+}
+
+// Export 导出任务的队列、访问记录或cookie
+func (t *Task) Export(w io.Writer, opt ResetOption) error {
+	return writeFrontier(w, &frontierHeader{Tongs: t.tongs.Name, Task: t.Name}, func(fn func(rec *FrontierRecord) error) error {
+		return t.export(opt, fn)
+	})
+}
+
+// Import 导入到任务,只导入当前任务和Tongs内共用的记录,其他任务导出的文件不能导入
+func (t *Task) Import(r io.Reader, opt ResetOption) (int, error) {
+	skipped := 0
+	n, err := readFrontier(r, opt, func(h *frontierHeader) error {
+		if h.Task != "" && h.Task != t.Name {
+			return errors.New(fmt.Sprintf("导入文件由任务【%s】导出,不能导入到任务【%s】", h.Task, t.Name))
+		}
+		return nil
+	}, func(recs []*FrontierRecord) error {
+		batch := make([]*FrontierRecord, 0, len(recs))
+		for _, rec := range recs {
+			if rec.Task != "" && rec.Task != t.Name {
+				skipped++
+				continue
+			}
+			batch = append(batch, rec)
+		}
+		return t.importRecords(batch)
+	})
+	if skipped > 0 {
+		Log.Warn(fmt.Sprintf("任务【%s-%s】导入时跳过其他任务的记录%d条", t.tongs.Name, t.Name, skipped))
+	}
+	return n - skipped, err
+}
+
+// Export 导出Tongs内所有任务,共用的访问记录和cookie只导出一次
+func (t *Tongs) Export(w io.Writer, opt ResetOption) error {
+	return writeFrontier(w, &frontierHeader{Tongs: t.Name}, func(fn func(rec *FrontierRecord) error) error {
+		shared := false
+		for _, task := range t.Tasks {
+			taskOpt := opt
+			if shared {
+				taskOpt &^= ResetCookies
+				if !Config.Bloom.Alone {
+					taskOpt &^= ResetVisited
+				}
+			}
+			if taskOpt == 0 {
+				continue
+			}
+			if err := task.export(taskOpt, fn); err != nil {
+				return err
+			}
+			shared = true
+		}
+		return nil
+	})
+}
+
+// Import 按任务名称导入到Tongs内的任务,共用的记录导入到第一个任务,找不到的任务跳过
+func (t *Tongs) Import(r io.Reader, opt ResetOption) (int, error) {
+	if len(t.Tasks) == 0 {
+		return 0, errors.New("当前Tongs内没有任务")
+	}
+	skipped := 0
+	n, err := readFrontier(r, opt, nil, func(recs []*FrontierRecord) error {
+		var tasks []*Task
+		batches := make(map[*Task][]*FrontierRecord)
+		for _, rec := range recs {
+			task := t.Tasks[0]
+			if rec.Task != "" {
+				found, err := t.findTaskWithName(rec.Task)
+				if err != nil {
+					skipped++
+					continue
+				}
+				task = found
+			}
+			if _, ok := batches[task]; !ok {
+				tasks = append(tasks, task)
+			}
+			batches[task] = append(batches[task], rec)
+		}
+		for _, task := range tasks {
+			if err := task.importRecords(batches[task]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if skipped > 0 {
+		Log.Warn(fmt.Sprintf("【%s】导入时跳过不存在的任务的记录%d条", t.Name, skipped))
+	}
+	return n - skipped, err
+}
+
+func (t *Task) export(opt ResetOption, fn func(rec *FrontierRecord) error) error {
+	s, ok := t.store.(ExportStore)
+	if !ok {
+		return errors.New(fmt.Sprintf("任务【%s】的存储器不支持导出", t.Name))
+	}
+	return s.Export(opt, func(rec *FrontierRecord) error {
+		rec.Task = t.Name
+		if rec.Type == recordCookie || rec.Type == recordIdentity || rec.Type == recordIdentityCookie ||
+			(!Config.Bloom.Alone && (rec.Type == recordVisited || rec.Type == recordBloom)) {
+			rec.Task = ""
+		}
+		return fn(rec)
+	})
+}
+
+func (t *Task) importRecords(recs []*FrontierRecord) error {
+	if len(recs) == 0 {
+		return nil
+	}
+	s, ok := t.store.(ExportStore)
+	if !ok {
+		return errors.New(fmt.Sprintf("任务【%s】的存储器不支持导入", t.Name))
+	}
+	if err := s.Import(recs); err != nil {
+		return err
+	}
+	if t.IsQueue {
+		t.queue.notify()
+	}
+	return nil
+}
+
+func writeFrontier(w io.Writer, header *frontierHeader, export func(fn func(rec *FrontierRecord) error) error) error {
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	header.Version = frontierVersion
+	header.ExportedAt = time.Now().Unix()
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	if err := export(func(rec *FrontierRecord) error {
+		return enc.Encode(rec)
+	}); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// readFrontier 读取导出文件,check不为空时检查文件头,只导入opt包含的记录,按批调用fn,返回读取的记录数
+func readFrontier(r io.Reader, opt ResetOption, check func(h *frontierHeader) error, fn func(recs []*FrontierRecord) error) (int, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("导入文件格式错误: %s", err.Error()))
+	}
+	defer zr.Close()
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	header := &frontierHeader{}
+	if err := dec.Decode(header); err != nil {
+		return 0, errors.New(fmt.Sprintf("导入文件格式错误: %s", err.Error()))
+	}
+	if header.Version != frontierVersion {
+		return 0, errors.New(fmt.Sprintf("不支持的导入文件版本【%d】", header.Version))
+	}
+	if check != nil {
+		if err := check(header); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	batch := make([]*FrontierRecord, 0, frontierBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := fn(batch); err != nil {
+			return err
+		}
+		n += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+	for {
+		rec := &FrontierRecord{}
+		if err := dec.Decode(rec); err == io.EOF {
+			return n, flush()
+		} else if err != nil {
+			return n, errors.New(fmt.Sprintf("导入文件第%d条记录错误: %s", n+len(batch)+1, err.Error()))
+		}
+		if !opt.Has(recordScope(rec.Type)) {
+			continue
+		}
+		batch = append(batch, rec)
+		if len(batch) == frontierBatchSize {
+			if err := flush(); err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+func recordScope(typ string) ResetOption {
+	switch typ {
+	case recordRequest, recordDelayed:
+		return ResetQueue
+	case recordVisited, recordBloom:
+		return ResetVisited
+	default:
+		return ResetCookies
+	}
+}
+
+// redisExportQueue 导出redis中的队列,处理中的请求作为普通请求导出
+func redisExportQueue(c redis.UniversalClient, id string, fn func(rec *FrontierRecord) error) error {
+	for offset := 0; ; offset += inspectPageSize {
+		requests, err := redisPeek(c, id, offset, inspectPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			if err := fn(&FrontierRecord{Type: recordRequest, Data: r}); err != nil {
+				return err
+			}
+		}
+		if len(requests) < inspectPageSize {
+			break
+		}
+	}
+	inflight, err := c.ZRange(inflightKey(id), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, r := range inflight {
+		if err := fn(&FrontierRecord{Type: recordRequest, Data: []byte(r)}); err != nil {
+			return err
+		}
+	}
+	delayed, err := c.ZRangeWithScores(delayedKey(id), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, z := range delayed {
+		if err := fn(&FrontierRecord{Type: recordDelayed, Data: []byte(z.Member.(string)), Time: int64(z.Score)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redisExportCookies 导出cookie和账号
+func redisExportCookies(c redis.UniversalClient, tongs string, fn func(rec *FrontierRecord) error) error {
+	cookies, err := c.HGetAll(fmt.Sprintf("%s:cookie", tongs)).Result()
+	if err != nil {
+		return err
+	}
+	for host, v := range cookies {
+		if err := fn(&FrontierRecord{Type: recordCookie, Key: host, Data: []byte(v)}); err != nil {
+			return err
+		}
+	}
+	identities, err := c.HGetAll(identitiesKey(tongs)).Result()
+	if err != nil {
+		return err
+	}
+	for name, v := range identities {
+		if err := fn(&FrontierRecord{Type: recordIdentity, Key: name, Data: []byte(v)}); err != nil {
+			return err
+		}
+		cookies, err := c.HGetAll(identityCookieKey(tongs, name)).Result()
+		if err != nil {
+			return err
+		}
+		for host, v := range cookies {
+			if err := fn(&FrontierRecord{Type: recordIdentityCookie, Key: name, Field: host, Data: []byte(v)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// redisImport 在一个管道中导入一批记录,访问记录和布隆过滤器分块由存储器的visited处理
+func redisImport(c redis.UniversalClient, id, tongs string, recs []*FrontierRecord, visited func(pipe redis.Pipeliner, rec *FrontierRecord) error) error {
+	_, err := c.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, rec := range recs {
+			var err error
+			switch rec.Type {
+			case recordRequest:
+				err = redisPush(pipe, id, rec.Data)
+			case recordDelayed:
+				err = redisDelayed(pipe, id, rec.Data, time.UnixMilli(rec.Time))
+			case recordVisited, recordBloom:
+				err = visited(pipe, rec)
+			case recordCookie:
+				pipe.HSet(fmt.Sprintf("%s:cookie", tongs), rec.Key, string(rec.Data))
+			case recordIdentity:
+				pipe.HSet(identitiesKey(tongs), rec.Key, string(rec.Data))
+			case recordIdentityCookie:
+				pipe.HSet(identityCookieKey(tongs, rec.Key), rec.Field, string(rec.Data))
+			default:
+				err = errors.New(fmt.Sprintf("不支持的导入记录【%s】", rec.Type))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,265 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DependOnSuccess  = "success"  //上游执行完成后启动
+	DependOnFailure  = "failure"  //上游执行失败后启动
+	DependOnComplete = "complete" //上游执行完成或失败后都启动,被停止时不启动
+
+	nodePending = "pending" //等待上游结束
+	nodeRunning = "running" //运行中
+	nodeSkipped = "skipped" //上游结果不满足条件,本次不执行
+	nodeError   = "error"   //启动失败,如已被手动启动,不是运行失败,下游任务按不满足条件跳过
+)
+
+// Dependency 任务依赖的上游任务及启动条件
+type Dependency struct {
+	Task string `json:"task"`
+	On   string `json:"on"`
+}
+
+// GraphNode 依赖图中的任务及本次运行的状态
+type GraphNode struct {
+	Task    string        `json:"task"`
+	Depends []*Dependency `json:"depends,omitempty"`
+	State   string        `json:"state,omitempty"` //pending running skipped error 或运行结束的事件类型
+}
+
+// GraphInfo Tongs内的任务依赖图
+type GraphInfo struct {
+	Active    bool         `json:"active"` //是否正在按依赖运行
+	StartedAt *time.Time   `json:"startedAt,omitempty"`
+	Tasks     []*GraphNode `json:"tasks"`
+}
+
+// taskGraph Tongs内任务的依赖关系,Tongs启动时只启动没有依赖的任务,其余任务由上游的运行结束事件驱动启动
+type taskGraph struct {
+	mu        sync.Mutex
+	tongs     *Tongs
+	active    bool
+	startedAt time.Time
+	states    map[string]string
+}
+
+// DependsOn 上游任务全部执行完成后启动,只在通过Tongs启动时生效
+func (t *Task) DependsOn(tasks ...string) *Task {
+	return t.dependsOn(DependOnSuccess, tasks)
+}
+
+// DependsOnFailure 上游任务全部执行失败后启动,用于失败通知或补偿任务
+func (t *Task) DependsOnFailure(tasks ...string) *Task {
+	return t.dependsOn(DependOnFailure, tasks)
+}
+
+// DependsOnComplete 上游任务全部结束后启动,不论成功或失败
+func (t *Task) DependsOnComplete(tasks ...string) *Task {
+	return t.dependsOn(DependOnComplete, tasks)
+}
+
+func (t *Task) dependsOn(on string, tasks []string) *Task {
+	for _, name := range tasks {
+		t.Depends = append(t.Depends, &Dependency{Task: name, On: on})
+	}
+	return t
+}
+
+// initDependencies 按 配置文件 > 代码设置 加载任务依赖并检查是否有循环依赖
+func initDependencies(t *Tongs) {
+	for _, task := range t.Tasks {
+		if c := taskConfig(task); len(c.Depends) > 0 {
+			task.Depends = task.Depends[:0]
+			for _, d := range c.Depends {
+				task.Depends = append(task.Depends, &Dependency{Task: d.Task, On: d.On})
+			}
+		}
+	}
+	if err := t.graph.validate(); err != nil {
+		panic(fmt.Sprintf("【%s】任务依赖配置错误,error:%s", t.Name, err.Error()))
+	}
+}
+
+// Graph 获取任务依赖图及本次运行的状态
+func (t *Tongs) Graph() *GraphInfo {
+	return t.graph.info()
+}
+
+func (g *taskGraph) enabled() bool {
+	for _, task := range g.tongs.Tasks {
+		if len(task.Depends) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *taskGraph) isActive() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.active
+}
+
+func (g *taskGraph) validate() error {
+	tasks := make(map[string]*Task, len(g.tongs.Tasks))
+	for _, task := range g.tongs.Tasks {
+		tasks[task.Name] = task
+	}
+	for _, task := range g.tongs.Tasks {
+		for _, d := range task.Depends {
+			if d.On == "" {
+				d.On = DependOnSuccess
+			}
+			if d.On != DependOnSuccess && d.On != DependOnFailure && d.On != DependOnComplete {
+				return errors.New(fmt.Sprintf("任务【%s】依赖条件【%s】不支持", task.Name, d.On))
+			}
+			if _, ok := tasks[d.Task]; !ok {
+				return errors.New(fmt.Sprintf("任务【%s】依赖的任务【%s】不存在", task.Name, d.Task))
+			}
+		}
+	}
+	//0: 未访问 1: 访问中 2: 已完成
+	visits := make(map[string]int, len(tasks))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch visits[name] {
+		case 1:
+			return errors.New(fmt.Sprintf("任务存在循环依赖: %v", append(path, name)))
+		case 2:
+			return nil
+		}
+		visits[name] = 1
+		for _, d := range tasks[name].Depends {
+			if err := visit(d.Task, append(path, name)); err != nil {
+				return err
+			}
+		}
+		visits[name] = 2
+		return nil
+	}
+	for _, task := range g.tongs.Tasks {
+		if err := visit(task.Name, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// run 启动没有依赖的任务,urls按任务顺序对应启动url,trigger为没有依赖的任务的触发方式
+func (g *taskGraph) run(trigger string, urls []string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.active {
+		return errors.New(fmt.Sprintf("【%s】正在按依赖运行", g.tongs.Name))
+	}
+	for _, task := range g.tongs.Tasks {
+		if task.active() {
+			return errors.New(fmt.Sprintf("任务【%s】运行中,不能按依赖启动【%s】", task.Name, g.tongs.Name))
+		}
+	}
+	g.active = true
+	g.startedAt = time.Now()
+	g.states = make(map[string]string, len(g.tongs.Tasks))
+	for i, task := range g.tongs.Tasks {
+		if len(task.Depends) > 0 {
+			g.states[task.Name] = nodePending
+			continue
+		}
+		url := ""
+		if i < len(urls) {
+			url = urls[i]
+		}
+		g.start(task, url, trigger)
+	}
+	Log.Info(fmt.Sprintf("【%s】按依赖启动", g.tongs.Name))
+	g.advance()
+	return nil
+}
+
+// start 启动任务,调用方持有锁
+// 启动失败时任务没有运行,不按运行失败处理,避免错误地启动failure条件的下游任务
+func (g *taskGraph) start(task *Task, url, trigger string) {
+	g.states[task.Name] = nodeRunning
+	if err := task.run(url, trigger); err != nil {
+		Log.Error(fmt.Sprintf("【%s】按依赖启动任务【%s】失败, err:%s", g.tongs.Name, task.Name, err.Error()))
+		g.states[task.Name] = nodeError
+	}
+}
+
+// onComplete 记录任务结果并启动满足条件的下游任务,不是由依赖图启动的运行不处理
+func (g *taskGraph) onComplete(task *Task, e *TaskEvent) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.active || g.states[task.Name] != nodeRunning {
+		return
+	}
+	g.states[task.Name] = e.Type
+	g.advance()
+}
+
+// advance 上游全部结束的任务按条件启动或跳过,跳过会继续影响下游,调用方持有锁
+func (g *taskGraph) advance() {
+	for changed := true; changed; {
+		changed = false
+		for _, task := range g.tongs.Tasks {
+			if g.states[task.Name] != nodePending {
+				continue
+			}
+			ready, satisfied := true, true
+			for _, d := range task.Depends {
+				state := g.states[d.Task]
+				if state == nodePending || state == nodeRunning {
+					ready = false
+					break
+				}
+				switch d.On {
+				case DependOnFailure:
+					satisfied = satisfied && state == EventFailed
+				case DependOnComplete:
+					satisfied = satisfied && (state == EventFinished || state == EventFailed)
+				default:
+					satisfied = satisfied && state == EventFinished
+				}
+			}
+			if !ready {
+				continue
+			}
+			changed = true
+			if satisfied {
+				Log.Info(fmt.Sprintf("【%s】上游任务已结束,启动任务【%s】", g.tongs.Name, task.Name))
+				g.start(task, "", TriggerDependency)
+			} else {
+				Log.Info(fmt.Sprintf("【%s】上游任务结果不满足条件,跳过任务【%s】", g.tongs.Name, task.Name))
+				g.states[task.Name] = nodeSkipped
+			}
+		}
+	}
+	for _, state := range g.states {
+		if state == nodePending || state == nodeRunning {
+			return
+		}
+	}
+	g.active = false
+	Log.Info(fmt.Sprintf("【%s】按依赖运行结束", g.tongs.Name))
+}
+
+func (g *taskGraph) info() *GraphInfo {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	info := &GraphInfo{Active: g.active, Tasks: make([]*GraphNode, 0, len(g.tongs.Tasks))}
+	if !g.startedAt.IsZero() {
+		startedAt := g.startedAt
+		info.StartedAt = &startedAt
+	}
+	for _, task := range g.tongs.Tasks {
+		info.Tasks = append(info.Tasks, &GraphNode{Task: task.Name, Depends: task.Depends, State: g.states[task.Name]})
+	}
+	return info
+}
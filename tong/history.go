@@ -0,0 +1,195 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+	"gorm.io/gorm"
+)
+
+const (
+	TriggerManual     = "manual"     //通过接口或代码启动
+	TriggerSchedule   = "schedule"   //定时启动
+	TriggerDependency = "dependency" //上游任务结束后启动
+	TriggerWorker     = "worker"     //其他进程发出的启动命令
+
+	RunRunning = "running" //运行记录的状态,运行结束后为运行结束事件的类型
+)
+
+// DB 记录任务运行历史的数据库,为空时不记录
+var DB *gorm.DB
+
+// TaskRun 任务的一次运行记录
+type TaskRun struct {
+	ID         uint       `gorm:"primarykey" json:"id"`
+	Tongs      string     `gorm:"size:100;index:idx_task_run_task" json:"tongs"`
+	Task       string     `gorm:"size:100;index:idx_task_run_task" json:"task"`
+	TaskID     string     `gorm:"size:191" json:"taskId"`
+	Trigger    string     `gorm:"column:run_trigger;size:20" json:"trigger"` //manual schedule dependency
+	StartUrl   string     `gorm:"size:2048" json:"startUrl,omitempty"`
+	Status     string     `gorm:"size:20" json:"status"` //running finished failed stopped
+	StartedAt  time.Time  `json:"startedAt"`
+	EndedAt    *time.Time `json:"endedAt,omitempty"`
+	Requests   int64      `json:"requests"`  //发出的请求数量
+	Responses  int64      `json:"responses"` //成功的响应数量
+	Errors     int64      `json:"errors"`    //失败的请求数量,包括重试
+	Items      int64      `json:"items"`     //通过任务保存的item数量
+	StopReason string     `gorm:"size:255" json:"stopReason,omitempty"`
+	Error      string     `gorm:"type:text" json:"error,omitempty"`
+}
+
+// runCounters 本次运行的计数
+type runCounters struct {
+	requests  int64
+	responses int64
+	errors    int64
+	items     int64
+}
+
+// InitHistory 创建或更新运行记录表
+func InitHistory(db *gorm.DB) error {
+	DB = db
+	if DB == nil {
+		return nil
+	}
+	return DB.AutoMigrate(&TaskRun{})
+}
+
+// initRunCounters 统计每次运行的请求、响应和错误数量,被中止的请求不统计
+// 需要在其他请求回调之后注册,同时清除请求的中止标记
+func initRunCounters(t *Task) {
+	t.collector.OnRequest(func(r *colly.Request) {
+		if _, aborted := t.aborted.LoadAndDelete(r.ID); aborted {
+			return
+		}
+		atomic.AddInt64(&t.counters.requests, 1)
+	})
+	t.collector.OnResponse(func(r *colly.Response) {
+		atomic.AddInt64(&t.counters.responses, 1)
+	})
+	t.collector.OnError(func(r *colly.Response, err error) {
+		atomic.AddInt64(&t.counters.errors, 1)
+	})
+}
+
+// startRun 开始一次运行,重置计数并写入运行记录
+func (t *Task) startRun(url, trigger string) {
+	atomic.StoreInt64(&t.counters.requests, 0)
+	atomic.StoreInt64(&t.counters.responses, 0)
+	atomic.StoreInt64(&t.counters.errors, 0)
+	atomic.StoreInt64(&t.counters.items, 0)
+	runs.Add(1)
+	if url == "" {
+		url = t.StartUrl
+	}
+	if trigger == "" {
+		trigger = TriggerManual
+	}
+	run := &TaskRun{
+		Tongs:     t.tongs.Name,
+		Task:      t.Name,
+		TaskID:    t.ID,
+		Trigger:   trigger,
+		StartUrl:  url,
+		Status:    RunRunning,
+		StartedAt: time.Now(),
+	}
+	if DB != nil {
+		if err := DB.Create(run).Error; err != nil {
+			Log.Error(fmt.Sprintf("任务【%s-%s】写入运行记录失败, err:%s", t.tongs.Name, t.Name, err.Error()))
+		}
+	}
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	t.stopReason = ""
+	t.lastRun = run
+}
+
+// finishRun 运行结束,记录状态和计数,返回运行记录的副本用于保存,需要在再次启动前调用
+// 每次运行只结束一次,已结束时返回nil,如停止超时后已按停止保存的运行
+func (t *Task) finishRun(e *TaskEvent) *TaskRun {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	run := t.lastRun
+	if run == nil || run.Status != RunRunning {
+		return nil
+	}
+	end := e.At
+	run.EndedAt = &end
+	run.Status = e.Type
+	run.Error = e.Error
+	if e.Type == EventStopped {
+		run.StopReason = t.stopReason
+	}
+	run.Requests = atomic.LoadInt64(&t.counters.requests)
+	run.Responses = atomic.LoadInt64(&t.counters.responses)
+	run.Errors = atomic.LoadInt64(&t.counters.errors)
+	run.Items = atomic.LoadInt64(&t.counters.items)
+	saved := *run
+	return &saved
+}
+
+// saveRun 更新运行记录
+func saveRun(run *TaskRun) {
+	if DB == nil || run == nil || run.ID == 0 {
+		return
+	}
+	if err := DB.Save(run).Error; err != nil {
+		Log.Error(fmt.Sprintf("任务【%s-%s】更新运行记录失败, err:%s", run.Tongs, run.Task, err.Error()))
+	}
+}
+
+// LastRun 获取最近一次运行记录,运行中时计数为当前值
+func (t *Task) LastRun() *TaskRun {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	if t.lastRun == nil {
+		return nil
+	}
+	run := *t.lastRun
+	if run.Status == RunRunning {
+		run.Requests = atomic.LoadInt64(&t.counters.requests)
+		run.Responses = atomic.LoadInt64(&t.counters.responses)
+		run.Errors = atomic.LoadInt64(&t.counters.errors)
+		run.Items = atomic.LoadInt64(&t.counters.items)
+	}
+	return &run
+}
+
+// History 按启动时间倒序获取从offset开始的最多n条运行记录及总数
+func (t *Task) History(offset, n int) ([]*TaskRun, int64, error) {
+	if DB == nil {
+		return nil, 0, errors.New("未配置数据库,没有运行记录")
+	}
+	var total int64
+	runs := make([]*TaskRun, 0)
+	query := func() *gorm.DB {
+		return DB.Model(&TaskRun{}).Where("tongs = ? AND task = ?", t.tongs.Name, t.Name)
+	}
+	if err := query().Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+	if err := query().Order("id desc").Offset(offset).Limit(n).Find(&runs).Error; err != nil {
+		return nil, 0, err
+	}
+	return runs, total, nil
+}
+
+// HistoryRun 获取任务的一条运行记录
+func (t *Task) HistoryRun(id uint) (*TaskRun, error) {
+	if DB == nil {
+		return nil, errors.New("未配置数据库,没有运行记录")
+	}
+	run := &TaskRun{}
+	err := DB.Where("id = ? AND tongs = ? AND task = ?", id, t.tongs.Name, t.Name).First(run).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, errors.New(fmt.Sprintf("任务【%s】没有运行记录【%d】", t.Name, id))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
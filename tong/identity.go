@@ -0,0 +1,365 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/storage"
+)
+
+const (
+	RotationRequest = "request" //每个请求轮换账号
+	RotationSession = "session" //任务每次运行固定使用一个账号,账号停用后切换到下一个
+
+	identityRefreshInterval = 30 * time.Second //账号列表的缓存时间
+	identityAssignTimeout   = 10 * time.Minute //请求分配账号后超过该时间没有响应视为已被中止,清除分配记录
+)
+
+// Identity Tongs内的一个cookie账号,每个账号有独立的cookie,同一Tongs内的任务共用账号池
+type Identity struct {
+	Name      string `json:"name"`
+	Retired   bool   `json:"retired"`          //是否已停用,停用的账号不参与轮换
+	Reason    string `json:"reason,omitempty"` //停用原因
+	UpdatedAt int64  `json:"updatedAt"`
+}
+
+// IdentityStore 支持多账号cookie的存储器
+type IdentityStore interface {
+	// Identities 获取Tongs内所有账号
+	Identities() ([]*Identity, error)
+	// SaveIdentity 添加或更新账号状态
+	SaveIdentity(i *Identity) error
+	// RemoveIdentity 删除账号及其cookie
+	RemoveIdentity(name string) error
+	// IdentityCookies 获取账号在指定host下的cookie
+	IdentityCookies(name string, u *url.URL) string
+	// SetIdentityCookies 保存账号在指定host下的cookie
+	SetIdentityCookies(name string, u *url.URL, cookies string)
+}
+
+// identityBackend 账号实际保存的位置,位置相同的存储器只需要写入一次
+type identityBackend interface {
+	identityBackend() interface{}
+}
+
+// identityPool 任务使用的账号池,按轮换策略为每个请求分配账号
+type identityPool struct {
+	task         *Task
+	store        IdentityStore
+	rotation     string
+	retireStatus []int
+	mu           sync.Mutex
+	active       []string
+	loadedAt     time.Time
+	next         int
+	current      string   //session模式当前使用的账号
+	assigned     sync.Map //请求ID -> *identityAssignment
+}
+
+// identityAssignment 请求分配的账号
+type identityAssignment struct {
+	name string
+	at   time.Time
+}
+
+// initIdentity 开启账号轮换后关闭collector自带的cookie管理,由请求和响应回调读写当前账号的cookie
+func initIdentity(t *Task) {
+	c := Config.Identity
+	if tc := taskConfig(t); tc.Identity != nil {
+		c = *tc.Identity
+	} else if t.IdentityRotation != "" {
+		c.Rotation = t.IdentityRotation
+		if len(t.retireStatus) > 0 {
+			c.RetireStatus = t.retireStatus
+		}
+	}
+	if c.Rotation == "" {
+		return
+	}
+	if c.Rotation != RotationRequest && c.Rotation != RotationSession {
+		panic(fmt.Sprintf("任务【%s】ID:【%s】账号轮换策略【%s】不支持", t.tongs.Name+":"+t.Name, t.ID, c.Rotation))
+	}
+	s, ok := t.store.(IdentityStore)
+	if !ok {
+		panic(fmt.Sprintf("任务【%s】ID:【%s】的存储器不支持多账号", t.tongs.Name+":"+t.Name, t.ID))
+	}
+	t.IdentityRotation = c.Rotation
+	p := &identityPool{task: t, store: s, rotation: c.Rotation, retireStatus: c.RetireStatus}
+	t.identities = p
+	Log.Debug(fmt.Sprintf("任务【%s-%s】启动账号轮换【%s】", t.tongs.Name, t.Name, c.Rotation))
+
+	t.collector.DisableCookies()
+	t.collector.OnRequest(func(r *colly.Request) {
+		if t.isAborted(r) {
+			return
+		}
+		name := p.pick()
+		if name == "" {
+			Log.Warn(fmt.Sprintf("任务【%s-%s】没有可用账号,请求不携带cookie: %s", t.tongs.Name, t.Name, r.URL.String()))
+			return
+		}
+		p.assigned.Store(r.ID, &identityAssignment{name: name, at: time.Now()})
+		if cookie := requestCookie(p.store.IdentityCookies(name, r.URL)); cookie != "" {
+			r.Headers.Set("Cookie", cookie)
+		}
+	})
+	t.collector.OnResponse(func(r *colly.Response) {
+		if a, ok := p.assigned.Load(r.Request.ID); ok {
+			p.saveCookies(a.(*identityAssignment).name, r)
+		}
+	})
+	//解析回调中仍可以通过RequestIdentity获取账号,全部回调完成后清除
+	t.collector.OnScraped(func(r *colly.Response) {
+		p.assigned.Delete(r.Request.ID)
+	})
+	t.collector.OnError(func(r *colly.Response, err error) {
+		a, ok := p.assigned.LoadAndDelete(r.Request.ID)
+		if !ok {
+			return
+		}
+		name := a.(*identityAssignment).name
+		p.saveCookies(name, r)
+		for _, status := range p.retireStatus {
+			if r.StatusCode == status {
+				if err := p.retire(name, fmt.Sprintf("响应状态码%d", r.StatusCode)); err != nil {
+					Log.Error(fmt.Sprintf("任务【%s-%s】停用账号【%s】失败, err:%s", t.tongs.Name, t.Name, name, err.Error()))
+				}
+				return
+			}
+		}
+	})
+}
+
+// pick 按轮换策略选择账号,没有可用账号时返回空
+func (p *identityPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.loadedAt) > identityRefreshInterval {
+		p.reload()
+	}
+	if len(p.active) == 0 {
+		return ""
+	}
+	if p.rotation == RotationSession && p.current != "" && p.isActive(p.current) {
+		return p.current
+	}
+	name := p.active[p.next%len(p.active)]
+	p.next++
+	p.current = name
+	return name
+}
+
+// reload 重新加载可用账号,调用方持有锁
+func (p *identityPool) reload() {
+	identities, err := p.store.Identities()
+	if err != nil {
+		Log.Error(fmt.Sprintf("任务【%s-%s】加载账号失败, err:%s", p.task.tongs.Name, p.task.Name, err.Error()))
+		return
+	}
+	p.active = p.active[:0]
+	for _, i := range identities {
+		if !i.Retired {
+			p.active = append(p.active, i.Name)
+		}
+	}
+	p.loadedAt = time.Now()
+	p.sweep()
+}
+
+// sweep 清除超时的分配记录,请求在之后的回调中被中止时不会有响应,分配记录只能按时间清除
+func (p *identityPool) sweep() {
+	p.assigned.Range(func(id, a interface{}) bool {
+		if time.Since(a.(*identityAssignment).at) > identityAssignTimeout {
+			p.assigned.Delete(id)
+		}
+		return true
+	})
+}
+
+func (p *identityPool) isActive(name string) bool {
+	for _, n := range p.active {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidate 账号变更后下次分配时重新加载
+func (p *identityPool) invalidate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.loadedAt = time.Time{}
+}
+
+// resetSession 任务重新运行时session模式重新选择账号
+func (p *identityPool) resetSession() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = ""
+	p.loadedAt = time.Time{}
+}
+
+func (p *identityPool) retire(name, reason string) error {
+	if err := retireIdentity(p.store, name, reason); err != nil {
+		return err
+	}
+	Log.Info(fmt.Sprintf("任务【%s-%s】账号【%s】已停用: %s", p.task.tongs.Name, p.task.Name, name, reason))
+	p.task.tongs.invalidateIdentities()
+	return nil
+}
+
+// saveCookies 将响应设置的cookie合并到账号中
+func (p *identityPool) saveCookies(name string, r *colly.Response) {
+	if r.Headers == nil {
+		return
+	}
+	received := (&http.Response{Header: *r.Headers}).Cookies()
+	if len(received) == 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	u := r.Request.URL
+	cookies := mergeCookies(storage.UnstringifyCookies(p.store.IdentityCookies(name, u)), received)
+	p.store.SetIdentityCookies(name, u, storage.StringifyCookies(cookies))
+}
+
+func retireIdentity(s IdentityStore, name, reason string) error {
+	identities, err := s.Identities()
+	if err != nil {
+		return err
+	}
+	for _, i := range identities {
+		if i.Name == name {
+			i.Retired = true
+			i.Reason = reason
+			i.UpdatedAt = time.Now().Unix()
+			return s.SaveIdentity(i)
+		}
+	}
+	return errors.New(fmt.Sprintf("账号【%s】不存在", name))
+}
+
+// mergeCookies 同名cookie使用新值,已过期或被删除的cookie移除
+func mergeCookies(old, received []*http.Cookie) []*http.Cookie {
+	merged := make(map[string]*http.Cookie, len(old)+len(received))
+	var names []string
+	for _, c := range append(old, received...) {
+		if _, ok := merged[c.Name]; !ok {
+			names = append(names, c.Name)
+		}
+		merged[c.Name] = c
+	}
+	now := time.Now()
+	cookies := make([]*http.Cookie, 0, len(names))
+	for _, name := range names {
+		c := merged[name]
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			continue
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies
+}
+
+// requestCookie 将保存的cookie转换为请求头
+func requestCookie(stored string) string {
+	if stored == "" {
+		return ""
+	}
+	var pairs []string
+	now := time.Now()
+	for _, c := range storage.UnstringifyCookies(stored) {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			continue
+		}
+		pairs = append(pairs, c.Name+"="+c.Value)
+	}
+	return strings.Join(pairs, "; ")
+}
+
+// parseCookieHeader 解析浏览器中复制的cookie请求头 如: a=1; b=2
+func parseCookieHeader(header string) []*http.Cookie {
+	r := &http.Request{Header: http.Header{"Cookie": {header}}}
+	return r.Cookies()
+}
+
+func identitiesKey(tongs string) string {
+	return fmt.Sprintf("%s:identities", tongs)
+}
+
+func identityCookieKey(tongs, name string) string {
+	return fmt.Sprintf("%s:cookie:%s", tongs, name)
+}
+
+// redis中账号列表保存在 <tongs>:identities 哈希中,每个账号的cookie保存在 <tongs>:cookie:<账号> 哈希中
+func redisIdentities(c redis.UniversalClient, tongs string) ([]*Identity, error) {
+	values, err := c.HGetAll(identitiesKey(tongs)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeIdentities(values)
+}
+
+func redisSaveIdentity(c redis.UniversalClient, tongs string, i *Identity) error {
+	bys, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	return c.HSet(identitiesKey(tongs), i.Name, string(bys)).Err()
+}
+
+// redisIdentityKeys 账号列表和所有账号cookie的key,重置cookie时一起删除,包括已删除账号残留的cookie
+func redisIdentityKeys(c redis.UniversalClient, tongs string) ([]string, error) {
+	keys, err := scanKeys(c, identityCookieKey(tongs, "*"))
+	if err != nil {
+		return nil, err
+	}
+	return append(keys, identitiesKey(tongs)), nil
+}
+
+func redisRemoveIdentity(c redis.UniversalClient, tongs, name string) error {
+	_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(identitiesKey(tongs), name)
+		pipe.Del(identityCookieKey(tongs, name))
+		return nil
+	})
+	return err
+}
+
+func redisIdentityCookies(c redis.UniversalClient, tongs, name string, u *url.URL) string {
+	cookies, err := c.HGet(identityCookieKey(tongs, name), u.Host).Result()
+	if err != nil && err != redis.Nil {
+		Log.Error(fmt.Sprintf("获取账号【%s】cookie失败, err:%s", name, err.Error()))
+	}
+	return cookies
+}
+
+func redisSetIdentityCookies(c redis.UniversalClient, tongs, name string, u *url.URL, cookies string) {
+	if err := c.HSet(identityCookieKey(tongs, name), u.Host, cookies).Err(); err != nil {
+		Log.Error(fmt.Sprintf("保存账号【%s】cookie失败, err:%s", name, err.Error()))
+	}
+}
+
+func decodeIdentities(values map[string]string) ([]*Identity, error) {
+	identities := make([]*Identity, 0, len(values))
+	for name, v := range values {
+		i := &Identity{}
+		if err := json.Unmarshal([]byte(v), i); err != nil {
+			return nil, errors.New(fmt.Sprintf("账号【%s】数据错误: %s", name, err.Error()))
+		}
+		identities = append(identities, i)
+	}
+	sort.Slice(identities, func(a, b int) bool { return identities[a].Name < identities[b].Name })
+	return identities, nil
+}
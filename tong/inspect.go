@@ -0,0 +1,240 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// inspectPageSize 遍历队列时每次读取的数量
+const inspectPageSize = 500
+
+// maxPeekSize 查看队列时一次最多返回的数量
+const maxPeekSize = 1000
+
+// InspectStore 支持查看和修改队列内容的存储器
+type InspectStore interface {
+	// PeekRequests 按出队顺序获取从offset开始的最多n个请求,不出队,n超过maxPeekSize时按maxPeekSize返回
+	PeekRequests(offset, n int) ([][]byte, error)
+	// RemoveRequest 从队列中删除请求,返回请求是否在队列中
+	RemoveRequest(r []byte) (bool, error)
+	// PushRequest 不去重直接入队,用于在任务之间移动请求
+	PushRequest(r []byte) error
+}
+
+// QueueEntry 队列中的请求
+type QueueEntry struct {
+	URL      string                 `json:"url"`
+	Method   string                 `json:"method"`
+	Depth    int                    `json:"depth"`
+	Priority int                    `json:"priority"`
+	Ctx      map[string]interface{} `json:"ctx,omitempty"`
+	raw      []byte
+}
+
+// QueueStat 任务队列长度
+type QueueStat struct {
+	Task     string `json:"task"`
+	Size     int    `json:"size"`     //等待执行的请求数量
+	Delayed  int    `json:"delayed"`  //等待到期的延迟请求数量
+	Inflight int    `json:"inflight"` //所有进程已出队但未确认的请求数量
+}
+
+func newQueueEntry(raw []byte) (*QueueEntry, error) {
+	req, err := parseRequest(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &QueueEntry{
+		URL:      req.URL,
+		Method:   req.Method,
+		Depth:    req.Depth,
+		Priority: req.priority(),
+		Ctx:      req.Ctx,
+		raw:      raw,
+	}, nil
+}
+
+// inspectStore 获取支持查看队列的存储器,仅队列任务可用
+func (t *Task) inspectStore() (InspectStore, error) {
+	if !t.IsQueue {
+		return nil, errors.New(fmt.Sprintf("【%s】普通任务没有队列", t.Name))
+	}
+	s, ok := t.store.(InspectStore)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("任务【%s】的存储器不支持查看队列", t.Name))
+	}
+	return s, nil
+}
+
+// QueueStat 获取队列长度,同时会将到期的延迟请求移入队列
+func (t *Task) QueueStat() (*QueueStat, error) {
+	if !t.IsQueue {
+		return nil, errors.New(fmt.Sprintf("【%s】普通任务没有队列", t.Name))
+	}
+	size, err := t.store.QueueSize()
+	if err != nil {
+		return nil, err
+	}
+	stat := &QueueStat{Task: t.Name, Size: size}
+	if s, ok := t.store.(DelayStore); ok {
+		if stat.Delayed, err = s.DelayedSize(); err != nil {
+			return nil, err
+		}
+	}
+	if s, ok := t.store.(CompletionStore); ok {
+		if stat.Inflight, err = s.InflightSize(); err != nil {
+			return nil, err
+		}
+	}
+	return stat, nil
+}
+
+// PeekQueue 按出队顺序查看队列中从offset开始的最多n个请求
+func (t *Task) PeekQueue(offset, n int) ([]*QueueEntry, error) {
+	s, err := t.inspectStore()
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || n <= 0 {
+		return nil, errors.New("offset不能小于0,数量必须大于0")
+	}
+	if n > maxPeekSize {
+		n = maxPeekSize
+	}
+	requests, err := s.PeekRequests(offset, n)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]*QueueEntry, 0, len(requests))
+	for _, r := range requests {
+		entry, err := newQueueEntry(r)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// SearchQueue 查找url包含keyword的请求,最多返回limit个,limit不大于0时返回全部
+func (t *Task) SearchQueue(keyword string, limit int) ([]*QueueEntry, error) {
+	var entries []*QueueEntry
+	err := t.scanQueue(func(e *QueueEntry) bool {
+		if strings.Contains(e.URL, keyword) {
+			entries = append(entries, e)
+		}
+		return limit <= 0 || len(entries) < limit
+	})
+	return entries, err
+}
+
+// RemoveQueued 删除队列中url相同的请求,返回删除的数量
+func (t *Task) RemoveQueued(urls ...string) (int, error) {
+	s, err := t.inspectStore()
+	if err != nil {
+		return 0, err
+	}
+	entries, err := t.findQueued(urls)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, e := range entries {
+		ok, err := s.RemoveRequest(e.raw)
+		if err != nil {
+			return removed, err
+		}
+		if ok {
+			removed++
+		}
+	}
+	Log.Info(fmt.Sprintf("队列任务【%s-%s】删除请求%d个", t.tongs.Name, t.Name, removed))
+	return removed, nil
+}
+
+// MoveQueued 将队列中url相同的请求移动到另一个队列任务,移动的请求不做去重,返回移动的数量
+func (t *Task) MoveQueued(to *Task, urls ...string) (int, error) {
+	s, err := t.inspectStore()
+	if err != nil {
+		return 0, err
+	}
+	target, err := to.inspectStore()
+	if err != nil {
+		return 0, err
+	}
+	if to == t {
+		return 0, errors.New("不能移动到当前任务")
+	}
+	entries, err := t.findQueued(urls)
+	if err != nil {
+		return 0, err
+	}
+	moved := 0
+	for _, e := range entries {
+		//先从原队列删除,已被其他线程取出的请求不再移动
+		ok, err := s.RemoveRequest(e.raw)
+		if err != nil {
+			return moved, err
+		}
+		if !ok {
+			continue
+		}
+		if err := target.PushRequest(e.raw); err != nil {
+			//放回原队列,避免请求丢失
+			if err := s.PushRequest(e.raw); err != nil {
+				Log.Error(fmt.Sprintf("队列任务【%s-%s】请求放回失败: %s, err:%s", t.tongs.Name, t.Name, e.URL, err.Error()))
+			}
+			return moved, err
+		}
+		moved++
+	}
+	to.queue.notify()
+	Log.Info(fmt.Sprintf("队列任务【%s-%s】移动请求%d个到【%s-%s】", t.tongs.Name, t.Name, moved, to.tongs.Name, to.Name))
+	return moved, nil
+}
+
+// findQueued 查找队列中url在urls中的请求
+func (t *Task) findQueued(urls []string) ([]*QueueEntry, error) {
+	if len(urls) == 0 {
+		return nil, errors.New("url不能为空")
+	}
+	set := make(map[string]struct{}, len(urls))
+	for _, u := range urls {
+		set[u] = struct{}{}
+	}
+	var entries []*QueueEntry
+	err := t.scanQueue(func(e *QueueEntry) bool {
+		if _, ok := set[e.URL]; ok {
+			entries = append(entries, e)
+		}
+		return true
+	})
+	return entries, err
+}
+
+// scanQueue 按出队顺序遍历队列,fn返回false时停止
+func (t *Task) scanQueue(fn func(e *QueueEntry) bool) error {
+	s, err := t.inspectStore()
+	if err != nil {
+		return err
+	}
+	for offset := 0; ; offset += inspectPageSize {
+		requests, err := s.PeekRequests(offset, inspectPageSize)
+		if err != nil {
+			return err
+		}
+		for _, r := range requests {
+			entry, err := newQueueEntry(r)
+			if err != nil {
+				continue
+			}
+			if !fn(entry) {
+				return nil
+			}
+		}
+		if len(requests) < inspectPageSize {
+			return nil
+		}
+	}
+}
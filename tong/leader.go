@@ -0,0 +1,150 @@
+package tong
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+var (
+	// 续约和释放只在租约仍属于当前进程时执行
+	renewScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`)
+	releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0`)
+
+	leaderListeners   []func(leader bool)
+	leaderListenersMu sync.RWMutex
+)
+
+// LeaderInfo 主进程信息
+type LeaderInfo struct {
+	Enabled  bool   `json:"enabled"`          //是否开启多进程协作,未开启时当前进程始终是主进程
+	Worker   string `json:"worker,omitempty"` //当前进程
+	Leader   string `json:"leader,omitempty"` //持有租约的进程
+	IsLeader bool   `json:"isLeader"`         //当前进程是否是主进程
+}
+
+// elector 基于redis租约的主进程选举,租约到期前由持有者续约,持有者退出或续约失败后由其他进程获得
+// 定时执行、超时请求回收和跨进程完成检查只在主进程执行
+type elector struct {
+	id     string
+	client redis.UniversalClient
+	ttl    time.Duration
+	leader atomic.Bool
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// IsLeader 当前进程是否是主进程,未开启多进程协作时始终为true
+func IsLeader() bool {
+	w := currentWorker
+	if w == nil || w.elector == nil {
+		return true
+	}
+	return w.elector.leader.Load()
+}
+
+// OnLeaderChange 监听当前进程成为或不再是主进程,回调在选举协程中执行
+func OnLeaderChange(fn func(leader bool)) {
+	leaderListenersMu.Lock()
+	defer leaderListenersMu.Unlock()
+	leaderListeners = append(leaderListeners, fn)
+}
+
+func leaderKey() string {
+	return withKeyPrefix("tongs:leader")
+}
+
+func newElector(id string, client redis.UniversalClient, ttl time.Duration) *elector {
+	return &elector{id: id, client: client, ttl: ttl, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+// start 立即参与一次选举,之后每隔租约时间的1/3续约或重新竞选
+func (e *elector) start() {
+	e.campaign()
+	go func() {
+		defer close(e.done)
+		ticker := time.NewTicker(e.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-e.stop:
+				return
+			case <-ticker.C:
+				e.campaign()
+			}
+		}
+	}()
+}
+
+func (e *elector) campaign() {
+	var leader bool
+	var err error
+	if e.leader.Load() {
+		var n int64
+		n, err = renewScript.Run(e.client, []string{leaderKey()}, e.id, e.ttl.Milliseconds()).Int64()
+		leader = err == nil && n == 1
+	} else {
+		leader, err = e.client.SetNX(leaderKey(), e.id, e.ttl).Result()
+	}
+	if err != nil {
+		Log.Error(fmt.Sprintf("进程【%s】选举失败, err:%s", e.id, err.Error()))
+		//无法确认租约时放弃主进程身份,避免与其他进程同时执行
+		leader = false
+	}
+	e.set(leader)
+}
+
+func (e *elector) set(leader bool) {
+	if e.leader.Swap(leader) == leader {
+		return
+	}
+	if leader {
+		Log.Info(fmt.Sprintf("进程【%s】成为主进程", e.id))
+	} else {
+		Log.Warn(fmt.Sprintf("进程【%s】不再是主进程", e.id))
+	}
+	leaderListenersMu.RLock()
+	listeners := append([]func(leader bool){}, leaderListeners...)
+	leaderListenersMu.RUnlock()
+	for _, fn := range listeners {
+		fn(leader)
+	}
+}
+
+// close 停止选举并释放租约,其他进程在下一次竞选时接替
+func (e *elector) close() {
+	close(e.stop)
+	<-e.done
+	if e.leader.Load() {
+		if err := releaseLeaseScript.Run(e.client, []string{leaderKey()}, e.id).Err(); err != nil {
+			Log.Error(fmt.Sprintf("进程【%s】释放租约失败, err:%s", e.id, err.Error()))
+		}
+	}
+	e.set(false)
+}
+
+// Leader 获取主进程信息
+func (m *Manager) Leader() (*LeaderInfo, error) {
+	w := currentWorker
+	if w == nil {
+		return &LeaderInfo{IsLeader: true}, nil
+	}
+	info := &LeaderInfo{Enabled: true, Worker: w.id, IsLeader: IsLeader()}
+	leader, err := w.client.Get(leaderKey()).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	info.Leader = leader
+	return info, nil
+}
@@ -11,25 +11,27 @@ import (
 
 	"github.com/go-redis/redis"
 	"github.com/gocolly/colly/v2"
-	"github.com/gocolly/colly/v2/queue"
 	"github.com/mozillazg/go-pinyin"
 	"go.uber.org/zap"
 )
 
 var (
 	managers   = make([]*Tongs, 0)
-	Redis      *redis.Client
-	BloomRedis *redis.Client
+	Redis      redis.UniversalClient
+	BloomRedis redis.UniversalClient
 	Config     config.Tongs
 	UserAgents = make(map[string][]string)
 	args       = pinyin.NewArgs()
 	taskIdMap  = map[string]string{}
 	Log        *zap.Logger
-	Status     = map[string]int{
-		"stop":     0,
-		"stopping": 1,
-		"running":  2,
-		"err":      3,
+	// Deprecated: 使用TaskStatus中的状态,如StatusRunning
+	Status = map[string]int{
+		"stop":     int(StatusStopped),
+		"stopping": int(StatusStopping),
+		"running":  int(StatusRunning),
+		"err":      int(StatusFailed),
+		"finished": int(StatusFinished),
+		"paused":   int(StatusPaused),
 	}
 )
 
@@ -41,7 +43,10 @@ func (m *Manager) Init() {
 		for _, task := range t.Tasks {
 			task.Init()
 		}
+		initDependencies(t)
 	}
+	initSchedules()
+	initWorker()
 }
 
 // AddTongs 添加Tongs
@@ -122,7 +127,9 @@ func (m *Manager) Stop(name string) error {
 }
 
 func newTongs(name string) *Tongs {
-	return &Tongs{Name: name, Tasks: make([]*Task, 0), lock: new(sync.Mutex), Ctx: make(map[string]interface{})}
+	t := &Tongs{Name: name, Tasks: make([]*Task, 0), lock: new(sync.Mutex), Ctx: make(map[string]interface{})}
+	t.graph = &taskGraph{tongs: t}
+	return t
 }
 func getTaskId(groupName string, taskName string) string {
 	key := groupName + ":" + taskName
@@ -135,32 +142,89 @@ func getTaskId(groupName string, taskName string) string {
 	taskIdMap[key] = id
 	return id
 }
-func initStore(t *Task) {
-	if Config.Bloom.Open {
-		t.store = &BloomStore{
-			Id:        t.ID,
-			TongsName: strings.Join(pinyin.LazyPinyin(t.tongs.Name, args), ""),
-			Client:    BloomRedis,
-			IsQueue:   t.IsQueue,
-		}
-	} else {
-		t.store = &TongsStore{
-			Id:        t.ID,
-			TongsName: strings.Join(pinyin.LazyPinyin(t.tongs.Name, args), ""),
-			Client:    Redis,
-			IsQueue:   t.IsQueue,
+func getTongsId(tongsName string) string {
+	return strings.Join(pinyin.LazyPinyin(tongsName, args), "")
+}
+
+// taskConfig 获取配置文件中该任务的配置,没有配置时返回空配置
+func taskConfig(t *Task) config.Task {
+	for _, c := range Config.Tasks {
+		if c.Tongs == t.tongs.Name && c.Task == t.Name {
+			return c
 		}
 	}
+	return config.Task{}
+}
+
+// initFingerprinter 按 任务代码设置 > 任务配置 > 全局配置 的顺序选择请求指纹
+func initFingerprinter(t *Task) {
+	if t.fingerprinter != nil {
+		return
+	}
+	c := Config.Fingerprint
+	if tc := taskConfig(t); tc.Fingerprint != nil {
+		c = *tc.Fingerprint
+	}
+	f, err := NewFingerprinter(c)
+	if err != nil {
+		panic(fmt.Sprintf("任务【%s】ID:【%s】请求指纹创建失败,error:%s", t.tongs.Name+":"+t.Name, t.ID, err.Error()))
+	}
+	t.fingerprinter = f
+}
+
+func initStore(t *Task) {
+	checkFreshness(t)
+	store, err := newStore(t)
+	if err != nil {
+		panic(fmt.Sprintf("任务【%s】ID:【%s】存储器创建失败,error:%s", t.tongs.Name+":"+t.Name, t.ID, err.Error()))
+	}
+	t.store = store
 
 	if t.IsQueue {
-		q, err := queue.New(t.Thread, t.store)
+		//队列任务在入队时由存储器去重,允许collector重复访问,否则延迟请求和回收的超时请求在同一进程内无法再次执行
+		t.collector.AllowURLRevisit = true
+		q, err := NewQueue(t.Thread, t.store)
 		if err != nil {
 			panic(fmt.Sprintf("任务【%s】ID:【%s】队列创建失败,error:%s", t.tongs.Name+":"+t.Name, t.ID, err.Error()))
 		}
+		q.IdleTimeout = idleTimeout(t)
+		q.name = t.tongs.Name + "-" + t.Name
 		t.queue = q
 	} else {
 		t.collector.SetStorage(t.store)
+		//普通任务在请求回调中按请求指纹去重,不使用colly按url和请求体计算的请求ID
+		if !t.collector.AllowURLRevisit {
+			t.collector.AllowURLRevisit = true
+			t.visitCheck = true
+		}
+	}
+}
+
+// checkFreshness Tongs内共用访问记录时,使用同一种存储器的任务有效期必须一致,否则按先写入的有效期清理会影响其他任务
+func checkFreshness(t *Task) {
+	if Config.Bloom.Alone {
+		return
+	}
+	for _, other := range t.tongs.Tasks {
+		if other == t || other.store == nil || storeTypeOf(other) != storeTypeOf(t) {
+			continue
+		}
+		if freshness(other) != freshness(t) {
+			panic(fmt.Sprintf("任务【%s】与【%s】在【%s】内共用访问记录,有效期必须一致: %d小时, %d小时",
+				t.Name, other.Name, t.tongs.Name, t.Freshness, other.Freshness))
+		}
+	}
+}
+
+// idleTimeout 按 任务配置 > 任务代码设置 > 全局配置 的顺序选择队列空闲超时时间
+func idleTimeout(t *Task) time.Duration {
+	if c := taskConfig(t); c.IdleTimeout > 0 {
+		return time.Duration(c.IdleTimeout) * time.Second
+	}
+	if t.idleTimeout > 0 {
+		return t.idleTimeout
 	}
+	return time.Duration(Config.Store.IdleTimeout) * time.Second
 }
 
 func autoUserAgent(task *Task) {
@@ -0,0 +1,950 @@
+package tong
+
+import (
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryDB 进程内存储空间,按照redis中key的组织方式保存队列、访问记录和cookie
+// 同一个key在不同任务之间共享,与TongsStore在redis中的行为保持一致
+type memoryDB struct {
+	mu       sync.RWMutex
+	queues   map[string]*memoryQueue
+	seq      uint64
+	inflight map[string]map[string]*memoryInflightItem
+	delayed  map[string][]*memoryDelayedItem
+	sets     map[string]map[uint64]int64 //访问记录,值为访问时间
+	hashes   map[string]map[string]string
+	journal  *fileJournal             //不为空时所有修改先写入日志,用于FileStore持久化
+	expires  map[string]time.Duration //设置了有效期的访问记录,过期的记录定时清除
+	refs     int                      //使用中的存储器数量,全部关闭后停止定时清除
+	sweeper  *time.Ticker
+	stop     chan struct{}
+}
+
+// visitedSweepInterval 清除过期访问记录的间隔
+const visitedSweepInterval = 10 * time.Minute
+
+// memoryOp 对memoryDB的一次修改操作,同时也是FileStore日志中的记录
+type memoryOp struct {
+	Op     string `json:"o"`
+	Key    string `json:"k"`
+	Field  string `json:"f,omitempty"`
+	Member uint64 `json:"m,omitempty"`
+	Value  []byte `json:"v,omitempty"`
+	Score  int    `json:"s,omitempty"`
+	Time   int64  `json:"t,omitempty"`
+}
+
+const (
+	opPush    = "push"
+	opRemove  = "remove" //从队列中删除一个内容为Value的请求
+	opPop     = "pop"    //出队,Field不为空时移入Field对应的处理中列表,Time为确认截止时间
+	opAck     = "ack"
+	opReclaim = "reclaim" //将Key处理中列表里截止时间不晚于Time的请求放回Field队列
+	opRelease = "release" //将Key处理中列表里内容为Value的请求放回Field队列
+	opDelay   = "delay"   //添加延迟请求,Time为到期时间
+	opPromote = "promote" //将Key中不晚于Time到期的延迟请求移入Field队列
+	opSAdd    = "sadd"    //添加访问记录,Time为访问时间
+	opHSet    = "hset"
+	opHDel    = "hdel"
+	opDel     = "del"
+)
+
+// memoryDelayedItem 等待到期的延迟请求
+type memoryDelayedItem struct {
+	Priority int    `json:"p"`
+	Value    []byte `json:"v"`
+	Due      int64  `json:"d"`
+}
+
+// memoryInflightItem 已出队但还未确认的请求
+type memoryInflightItem struct {
+	Priority int    `json:"p"`
+	Value    []byte `json:"v"`
+	Deadline int64  `json:"d"`
+	Seq      uint64 `json:"s"` //入队序号,放回队列时保持原来的顺序
+}
+
+// memoryQueueItem 优先级队列中的请求,优先级高的先出队,同优先级按序号先进先出
+type memoryQueueItem struct {
+	Priority int    `json:"p"`
+	Value    []byte `json:"v"`
+	Seq      uint64 `json:"s,omitempty"` //入队序号,旧版本快照中没有
+}
+
+// memoryQueue 实现heap.Interface的优先级队列
+type memoryQueue []*memoryQueueItem
+
+func (q memoryQueue) Len() int { return len(q) }
+func (q memoryQueue) Less(i, j int) bool {
+	if q[i].Priority != q[j].Priority {
+		return q[i].Priority > q[j].Priority
+	}
+	return q[i].Seq < q[j].Seq
+}
+func (q memoryQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *memoryQueue) Push(x interface{}) { *q = append(*q, x.(*memoryQueueItem)) }
+func (q *memoryQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return item
+}
+
+// items 按出队顺序返回队列中的请求
+func (q memoryQueue) items() []*memoryQueueItem {
+	sorted := make(memoryQueue, len(q))
+	copy(sorted, q)
+	items := make([]*memoryQueueItem, 0, len(q))
+	for sorted.Len() > 0 {
+		items = append(items, heap.Pop(&sorted).(*memoryQueueItem))
+	}
+	return items
+}
+
+// page 按出队顺序返回从offset开始的最多n个请求
+// 从堆顶开始按顺序遍历,只访问前offset+n个请求及其子节点,不复制和排序整个队列
+func (q memoryQueue) page(offset, n int) []*memoryQueueItem {
+	next := &memoryQueueCursor{q: q}
+	if len(q) > 0 {
+		next.idx = []int{0}
+	}
+	items := make([]*memoryQueueItem, 0, n)
+	for i := 0; next.Len() > 0 && i < offset+n; i++ {
+		k := heap.Pop(next).(int)
+		if i >= offset {
+			items = append(items, q[k])
+		}
+		for _, child := range []int{2*k + 1, 2*k + 2} {
+			if child < len(q) {
+				heap.Push(next, child)
+			}
+		}
+	}
+	return items
+}
+
+// memoryQueueCursor 按出队顺序遍历memoryQueue时待访问的节点下标,实现heap.Interface
+type memoryQueueCursor struct {
+	q   memoryQueue
+	idx []int
+}
+
+func (c memoryQueueCursor) Len() int            { return len(c.idx) }
+func (c memoryQueueCursor) Less(i, j int) bool  { return c.q.Less(c.idx[i], c.idx[j]) }
+func (c memoryQueueCursor) Swap(i, j int)       { c.idx[i], c.idx[j] = c.idx[j], c.idx[i] }
+func (c *memoryQueueCursor) Push(x interface{}) { c.idx = append(c.idx, x.(int)) }
+func (c *memoryQueueCursor) Pop() interface{} {
+	n := len(c.idx)
+	k := c.idx[n-1]
+	c.idx = c.idx[:n-1]
+	return k
+}
+
+// memory 进程内所有MemoryStore共用的存储空间
+var memory = newMemoryDB()
+
+func newMemoryDB() *memoryDB {
+	return &memoryDB{
+		queues:   make(map[string]*memoryQueue),
+		inflight: make(map[string]map[string]*memoryInflightItem),
+		delayed:  make(map[string][]*memoryDelayedItem),
+		sets:     make(map[string]map[uint64]int64),
+		hashes:   make(map[string]map[string]string),
+	}
+}
+
+// expire 设置访问记录的有效期,第一次设置时开始定时清除过期的记录
+func (db *memoryDB) expire(key string, d time.Duration) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.sweeper == nil {
+		db.expires = make(map[string]time.Duration)
+		db.sweeper = time.NewTicker(visitedSweepInterval)
+		db.stop = make(chan struct{})
+		go db.sweepLoop(db.sweeper, db.stop)
+	}
+	db.expires[key] = d
+}
+
+func (db *memoryDB) sweepLoop(ticker *time.Ticker, stop <-chan struct{}) {
+	for {
+		select {
+		case <-ticker.C:
+			db.mu.Lock()
+			db.sweep(time.Now())
+			db.mu.Unlock()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// acquire 存储器开始使用存储空间
+func (db *memoryDB) acquire() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.refs++
+}
+
+// release 存储器关闭,最后一个存储器关闭时停止定时清除并返回true
+func (db *memoryDB) release() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.refs == 0 {
+		return false
+	}
+	db.refs--
+	if db.refs > 0 {
+		return false
+	}
+	if db.sweeper != nil {
+		db.sweeper.Stop()
+		close(db.stop)
+		db.sweeper, db.stop, db.expires = nil, nil, nil
+	}
+	return true
+}
+
+// sweep 删除过期的访问记录,调用方需持有写锁
+// 过期的记录已不参与去重,删除不写入日志,重启后重放的过期记录会再次被清除
+func (db *memoryDB) sweep(now time.Time) {
+	for key, d := range db.expires {
+		since := now.Add(-d).UnixMilli()
+		for member, t := range db.sets[key] {
+			if t < since {
+				delete(db.sets[key], member)
+			}
+		}
+	}
+}
+
+// apply 执行一组修改操作,调用方需持有写锁
+// 开启日志时先写日志再修改内存,一组操作在日志中是一条记录,重启恢复时要么全部生效要么全部丢弃
+func (db *memoryDB) apply(ops ...memoryOp) error {
+	if db.journal != nil {
+		if err := db.journal.write(ops); err != nil {
+			return err
+		}
+	}
+	for _, op := range ops {
+		db.exec(op)
+	}
+	return nil
+}
+
+func (db *memoryDB) exec(op memoryOp) {
+	switch op.Op {
+	case opPush:
+		db.seq++
+		db.pushItem(op.Key, &memoryQueueItem{Priority: op.Score, Value: op.Value, Seq: db.seq})
+	case opPop:
+		q := db.queues[op.Key]
+		if q == nil || q.Len() == 0 {
+			return
+		}
+		item := heap.Pop(q).(*memoryQueueItem)
+		if q.Len() == 0 {
+			delete(db.queues, op.Key)
+		}
+		if op.Field != "" {
+			inflight, ok := db.inflight[op.Field]
+			if !ok {
+				inflight = make(map[string]*memoryInflightItem)
+				db.inflight[op.Field] = inflight
+			}
+			inflight[string(item.Value)] = &memoryInflightItem{Priority: item.Priority, Value: item.Value, Deadline: op.Time, Seq: item.Seq}
+		}
+	case opRemove:
+		q := db.queues[op.Key]
+		if q == nil {
+			return
+		}
+		for i, item := range *q {
+			if string(item.Value) == string(op.Value) {
+				heap.Remove(q, i)
+				break
+			}
+		}
+		if q.Len() == 0 {
+			delete(db.queues, op.Key)
+		}
+	case opAck:
+		delete(db.inflight[op.Key], string(op.Value))
+		if len(db.inflight[op.Key]) == 0 {
+			delete(db.inflight, op.Key)
+		}
+	case opRelease:
+		item, ok := db.inflight[op.Key][string(op.Value)]
+		if !ok {
+			return
+		}
+		delete(db.inflight[op.Key], string(op.Value))
+		db.pushItem(op.Field, &memoryQueueItem{Priority: item.Priority, Value: item.Value, Seq: item.Seq})
+		if len(db.inflight[op.Key]) == 0 {
+			delete(db.inflight, op.Key)
+		}
+	case opReclaim:
+		var expired []*memoryInflightItem
+		for _, item := range db.inflight[op.Key] {
+			if item.Deadline <= op.Time {
+				expired = append(expired, item)
+			}
+		}
+		//按截止时间放回,保证重放日志时顺序一致
+		sort.Slice(expired, func(i, j int) bool {
+			if expired[i].Deadline != expired[j].Deadline {
+				return expired[i].Deadline < expired[j].Deadline
+			}
+			return string(expired[i].Value) < string(expired[j].Value)
+		})
+		for _, item := range expired {
+			delete(db.inflight[op.Key], string(item.Value))
+			db.pushItem(op.Field, &memoryQueueItem{Priority: item.Priority, Value: item.Value, Seq: item.Seq})
+		}
+		if len(db.inflight[op.Key]) == 0 {
+			delete(db.inflight, op.Key)
+		}
+	case opDelay:
+		items := db.delayed[op.Key]
+		i := sort.Search(len(items), func(i int) bool { return items[i].Due > op.Time })
+		items = append(items, nil)
+		copy(items[i+1:], items[i:])
+		items[i] = &memoryDelayedItem{Priority: op.Score, Value: op.Value, Due: op.Time}
+		db.delayed[op.Key] = items
+	case opPromote:
+		items := db.delayed[op.Key]
+		n := db.due(op.Key, op.Time)
+		for _, item := range items[:n] {
+			db.seq++
+			db.pushItem(op.Field, &memoryQueueItem{Priority: item.Priority, Value: item.Value, Seq: db.seq})
+		}
+		if n == len(items) {
+			delete(db.delayed, op.Key)
+		} else {
+			db.delayed[op.Key] = items[n:]
+		}
+	case opSAdd:
+		set, ok := db.sets[op.Key]
+		if !ok {
+			set = make(map[uint64]int64)
+			db.sets[op.Key] = set
+		}
+		set[op.Member] = op.Time
+	case opHSet:
+		hash, ok := db.hashes[op.Key]
+		if !ok {
+			hash = make(map[string]string)
+			db.hashes[op.Key] = hash
+		}
+		hash[op.Field] = string(op.Value)
+	case opHDel:
+		delete(db.hashes[op.Key], op.Field)
+		if len(db.hashes[op.Key]) == 0 {
+			delete(db.hashes, op.Key)
+		}
+	case opDel:
+		delete(db.queues, op.Key)
+		delete(db.inflight, op.Key)
+		delete(db.delayed, op.Key)
+		delete(db.sets, op.Key)
+		delete(db.hashes, op.Key)
+	}
+}
+
+func (db *memoryDB) pushItem(key string, item *memoryQueueItem) {
+	q, ok := db.queues[key]
+	if !ok {
+		q = &memoryQueue{}
+		db.queues[key] = q
+	}
+	heap.Push(q, item)
+}
+
+func (db *memoryDB) front(key string) ([]byte, bool) {
+	q := db.queues[key]
+	if q == nil || q.Len() == 0 {
+		return nil, false
+	}
+	return (*q)[0].Value, true
+}
+
+// contains 队列中是否有内容为value的请求
+func (db *memoryDB) contains(key string, value []byte) bool {
+	if q := db.queues[key]; q != nil {
+		for _, item := range *q {
+			if string(item.Value) == string(value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (db *memoryDB) queueLen(key string) int {
+	if q := db.queues[key]; q != nil {
+		return q.Len()
+	}
+	return 0
+}
+
+// expired 处理中列表里截止时间不晚于deadline的请求数量
+func (db *memoryDB) expired(key string, deadline int64) int {
+	n := 0
+	for _, item := range db.inflight[key] {
+		if item.Deadline <= deadline {
+			n++
+		}
+	}
+	return n
+}
+
+// due 延迟请求中不晚于t到期的数量,延迟请求按到期时间排序
+func (db *memoryDB) due(key string, t int64) int {
+	items := db.delayed[key]
+	return sort.Search(len(items), func(i int) bool { return items[i].Due > t })
+}
+
+// sIsMember 访问时间不早于since的记录才算存在
+func (db *memoryDB) sIsMember(key string, member uint64, since int64) bool {
+	t, ok := db.sets[key][member]
+	return ok && t >= since
+}
+
+func (db *memoryDB) hGet(key, field string) string {
+	return db.hashes[key][field]
+}
+
+// MemoryStore 进程内存储器,不依赖redis,用于本地调试规则和单元测试
+type MemoryStore struct {
+	Id            string
+	TongsName     string
+	IsQueue       bool                 //是否是队列模式
+	Fingerprinter RequestFingerprinter //队列请求去重的指纹 为空则按url去重GET请求
+	Expires       time.Duration        //访问记录有效期 为0时永久有效
+	db            *memoryDB
+	closed        bool //已关闭,重复关闭时忽略
+}
+
+// Init initializes the memory storage
+func (s *MemoryStore) Init() error {
+	if s.Id == "" {
+		return errors.New("未设置任务ID")
+	}
+	if s.db == nil {
+		s.db = memory
+	}
+	s.db.acquire()
+	s.closed = false
+	if s.Expires > 0 {
+		s.db.expire(s.getVisitedID(), s.Expires)
+	}
+	return nil
+}
+
+// Close 关闭存储器,使用同一个存储空间的存储器全部关闭后停止定时清除过期的访问记录
+func (s *MemoryStore) Close() error {
+	s.release()
+	return nil
+}
+
+// release 释放存储空间,返回存储空间是否已没有存储器使用
+func (s *MemoryStore) release() bool {
+	if s.closed || s.db == nil {
+		return false
+	}
+	s.closed = true
+	return s.db.release()
+}
+
+// Clear removes all entries of the task from the storage
+func (s *MemoryStore) Clear() error {
+	return s.Reset(ResetAll)
+}
+
+// Reset 清除当前任务的队列、访问记录或cookie,访问记录和cookie在Tongs内共用时会一起清除
+func (s *MemoryStore) Reset(opt ResetOption) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	var ops []memoryOp
+	if opt.Has(ResetQueue) {
+		ops = append(ops,
+			memoryOp{Op: opDel, Key: s.getQueueID()},
+			memoryOp{Op: opDel, Key: s.getInflightID()},
+			memoryOp{Op: opDel, Key: s.getDelayedID()},
+		)
+	}
+	if opt.Has(ResetVisited) {
+		ops = append(ops, memoryOp{Op: opDel, Key: s.getVisitedID()})
+	}
+	if opt.Has(ResetCookies) {
+		ops = append(ops, memoryOp{Op: opDel, Key: s.getCookieID()}, memoryOp{Op: opDel, Key: identitiesKey(s.TongsName)})
+		for key := range s.db.hashes {
+			if strings.HasPrefix(key, identityCookieKey(s.TongsName, "")) {
+				ops = append(ops, memoryOp{Op: opDel, Key: key})
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return nil
+	}
+	return s.db.apply(ops...)
+}
+
+// Visited 非队列调用时通过该方法判断去重
+func (s *MemoryStore) Visited(requestID uint64) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(s.visit(requestID))
+}
+
+// IsVisited 非队列调用时通过该方法判断去重
+func (s *MemoryStore) IsVisited(requestID uint64) (bool, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.isVisited(requestID), nil
+}
+
+// Visit 记录访问,返回之前是否已访问过,判断和记录在同一个锁内完成
+func (s *MemoryStore) Visit(requestID uint64) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if s.isVisited(requestID) {
+		return true, nil
+	}
+	return false, s.db.apply(s.visit(requestID))
+}
+
+// visit 记录访问时间,访问记录过期后可再次添加
+func (s *MemoryStore) visit(requestID uint64) memoryOp {
+	return memoryOp{Op: opSAdd, Key: s.getVisitedID(), Member: requestID, Time: time.Now().UnixMilli()}
+}
+
+// isVisited 调用方需持有锁
+func (s *MemoryStore) isVisited(requestID uint64) bool {
+	var since int64
+	if s.Expires > 0 {
+		since = time.Now().Add(-s.Expires).UnixMilli()
+	}
+	return s.db.sIsMember(s.getVisitedID(), requestID, since)
+}
+
+// SetCookies implements colly/storage..SetCookies()
+func (s *MemoryStore) SetCookies(u *url.URL, cookies string) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.db.apply(memoryOp{Op: opHSet, Key: s.getCookieID(), Field: u.Host, Value: []byte(cookies)}); err != nil {
+		Log.Error(fmt.Sprintf("SetCookies() .Set error %s", err))
+	}
+}
+
+// Cookies implements colly/storage.Cookies()
+func (s *MemoryStore) Cookies(u *url.URL) string {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.db.hGet(s.getCookieID(), u.Host)
+}
+
+// identityBackend 同一进程内的MemoryStore共用一个存储空间
+func (s *MemoryStore) identityBackend() interface{} {
+	return s.db
+}
+
+// Identities 获取Tongs内所有账号
+func (s *MemoryStore) Identities() ([]*Identity, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return decodeIdentities(s.db.hashes[identitiesKey(s.TongsName)])
+}
+
+// SaveIdentity 添加或更新账号状态
+func (s *MemoryStore) SaveIdentity(i *Identity) error {
+	bys, err := json.Marshal(i)
+	if err != nil {
+		return err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(memoryOp{Op: opHSet, Key: identitiesKey(s.TongsName), Field: i.Name, Value: bys})
+}
+
+// RemoveIdentity 删除账号及其cookie
+func (s *MemoryStore) RemoveIdentity(name string) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(
+		memoryOp{Op: opHDel, Key: identitiesKey(s.TongsName), Field: name},
+		memoryOp{Op: opDel, Key: identityCookieKey(s.TongsName, name)},
+	)
+}
+
+// IdentityCookies 获取账号在指定host下的cookie
+func (s *MemoryStore) IdentityCookies(name string, u *url.URL) string {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return s.db.hGet(identityCookieKey(s.TongsName, name), u.Host)
+}
+
+// SetIdentityCookies 保存账号在指定host下的cookie
+func (s *MemoryStore) SetIdentityCookies(name string, u *url.URL, cookies string) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if err := s.db.apply(memoryOp{Op: opHSet, Key: identityCookieKey(s.TongsName, name), Field: u.Host, Value: []byte(cookies)}); err != nil {
+		Log.Error(fmt.Sprintf("保存账号【%s】cookie失败, err:%s", name, err.Error()))
+	}
+}
+
+// AddRequest implements queue.Storage.AddRequest() function
+func (s *MemoryStore) AddRequest(r []byte) error {
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	member, err := queueMember(r)
+	if err != nil {
+		return err
+	}
+	ops := []memoryOp{{Op: opPush, Key: s.getQueueID(), Value: member, Score: req.priority()}}
+	if reqId, dedupe := fingerprint(s.Fingerprinter, req); dedupe {
+		if s.isVisited(reqId) {
+			return nil
+		}
+		ops = append(ops, s.visit(reqId))
+	}
+	return s.db.apply(ops...)
+}
+
+// GetRequest implements queue.Storage.GetRequest() function
+func (s *MemoryStore) GetRequest() ([]byte, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	r, ok := s.db.front(s.getQueueID())
+	if !ok {
+		return nil, errQueueEmpty
+	}
+	deadline := time.Now().Add(visibilityTimeout()).UnixMilli()
+	if err := s.db.apply(memoryOp{Op: opPop, Key: s.getQueueID(), Field: s.getInflightID(), Time: deadline}); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Ack 请求处理完成后从处理中列表移除
+func (s *MemoryStore) Ack(r []byte) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.inflight[s.getInflightID()][string(r)]; !ok {
+		return nil
+	}
+	return s.db.apply(memoryOp{Op: opAck, Key: s.getInflightID(), Value: r})
+}
+
+// Release 将处理中的请求立即放回队列
+func (s *MemoryStore) Release(r []byte) error {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if _, ok := s.db.inflight[s.getInflightID()][string(r)]; !ok {
+		return nil
+	}
+	return s.db.apply(memoryOp{Op: opRelease, Key: s.getInflightID(), Field: s.getQueueID(), Value: r})
+}
+
+// Reclaim 将确认超时的请求放回队列
+func (s *MemoryStore) Reclaim() (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	now := time.Now().UnixMilli()
+	n := s.db.expired(s.getInflightID(), now)
+	if n == 0 {
+		return 0, nil
+	}
+	if err := s.db.apply(memoryOp{Op: opReclaim, Key: s.getInflightID(), Field: s.getQueueID(), Time: now}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// AddDelayedRequest 添加到期后才进入队列的请求
+func (s *MemoryStore) AddDelayedRequest(r []byte, at time.Time) error {
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	member, err := queueMember(r)
+	if err != nil {
+		return err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(memoryOp{Op: opDelay, Key: s.getDelayedID(), Value: member, Score: req.priority(), Time: at.UnixMilli()})
+}
+
+// DelayedSize 等待到期的延迟请求数量
+func (s *MemoryStore) DelayedSize() (int, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return len(s.db.delayed[s.getDelayedID()]), nil
+}
+
+// InflightSize 已出队但未确认的请求数量
+func (s *MemoryStore) InflightSize() (int, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return len(s.db.inflight[s.getInflightID()]), nil
+}
+
+// PeekRequests 按出队顺序获取请求,不出队
+func (s *MemoryStore) PeekRequests(offset, n int) ([][]byte, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	q := s.db.queues[s.getQueueID()]
+	if q == nil || offset >= q.Len() {
+		return nil, nil
+	}
+	if n > maxPeekSize {
+		n = maxPeekSize
+	}
+	items := q.page(offset, n)
+	requests := make([][]byte, 0, len(items))
+	for _, item := range items {
+		requests = append(requests, item.Value)
+	}
+	return requests, nil
+}
+
+// RemoveRequest 从队列中删除请求
+func (s *MemoryStore) RemoveRequest(r []byte) (bool, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	if !s.db.contains(s.getQueueID(), r) {
+		return false, nil
+	}
+	if err := s.db.apply(memoryOp{Op: opRemove, Key: s.getQueueID(), Value: r}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// PushRequest 不去重直接入队
+func (s *MemoryStore) PushRequest(r []byte) error {
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	member, err := queueMember(r)
+	if err != nil {
+		return err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(memoryOp{Op: opPush, Key: s.getQueueID(), Value: member, Score: req.priority()})
+}
+
+// AddDeadLetter 添加死信
+func (s *MemoryStore) AddDeadLetter(d *DeadLetter) error {
+	bys, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	return s.db.apply(memoryOp{Op: opHSet, Key: s.getDeadLetterID(), Field: d.ID, Value: bys})
+}
+
+// DeadLetters 按失败时间倒序获取死信
+func (s *MemoryStore) DeadLetters(offset, n int) ([]*DeadLetter, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	hash := s.db.hashes[s.getDeadLetterID()]
+	letters := make([]*DeadLetter, 0, len(hash))
+	for _, v := range hash {
+		d := &DeadLetter{}
+		if err := json.Unmarshal([]byte(v), d); err != nil {
+			return nil, err
+		}
+		letters = append(letters, d)
+	}
+	sortDeadLetters(letters)
+	if offset >= len(letters) {
+		return nil, nil
+	}
+	letters = letters[offset:]
+	if n >= 0 && n < len(letters) {
+		letters = letters[:n]
+	}
+	return letters, nil
+}
+
+// DeadLetterSize 死信数量
+func (s *MemoryStore) DeadLetterSize() (int, error) {
+	s.db.mu.RLock()
+	defer s.db.mu.RUnlock()
+	return len(s.db.hashes[s.getDeadLetterID()]), nil
+}
+
+// RemoveDeadLetter 删除死信
+func (s *MemoryStore) RemoveDeadLetter(id string) (*DeadLetter, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	v, ok := s.db.hashes[s.getDeadLetterID()][id]
+	if !ok {
+		return nil, nil
+	}
+	d := &DeadLetter{}
+	if err := json.Unmarshal([]byte(v), d); err != nil {
+		return nil, err
+	}
+	if err := s.db.apply(memoryOp{Op: opHDel, Key: s.getDeadLetterID(), Field: id}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// PurgeDeadLetters 清空死信
+func (s *MemoryStore) PurgeDeadLetters() (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	n := len(s.db.hashes[s.getDeadLetterID()])
+	if n == 0 {
+		return 0, nil
+	}
+	return n, s.db.apply(memoryOp{Op: opDel, Key: s.getDeadLetterID()})
+}
+
+// Export 导出队列、访问记录或cookie,在锁内复制记录后再逐条写出,写出较慢时不阻塞其他任务读写
+func (s *MemoryStore) Export(opt ResetOption, fn func(rec *FrontierRecord) error) error {
+	s.db.mu.RLock()
+	var records []*FrontierRecord
+	if opt.Has(ResetQueue) {
+		if q := s.db.queues[s.getQueueID()]; q != nil {
+			for _, item := range q.items() {
+				records = append(records, &FrontierRecord{Type: recordRequest, Data: item.Value})
+			}
+		}
+		for _, item := range s.db.inflight[s.getInflightID()] {
+			records = append(records, &FrontierRecord{Type: recordRequest, Data: item.Value})
+		}
+		for _, item := range s.db.delayed[s.getDelayedID()] {
+			records = append(records, &FrontierRecord{Type: recordDelayed, Data: item.Value, Time: item.Due})
+		}
+	}
+	if opt.Has(ResetVisited) {
+		for member, t := range s.db.sets[s.getVisitedID()] {
+			records = append(records, &FrontierRecord{Type: recordVisited, Member: member, Time: t})
+		}
+	}
+	if opt.Has(ResetCookies) {
+		for host, v := range s.db.hashes[s.getCookieID()] {
+			records = append(records, &FrontierRecord{Type: recordCookie, Key: host, Data: []byte(v)})
+		}
+		for name, v := range s.db.hashes[identitiesKey(s.TongsName)] {
+			records = append(records, &FrontierRecord{Type: recordIdentity, Key: name, Data: []byte(v)})
+			for host, v := range s.db.hashes[identityCookieKey(s.TongsName, name)] {
+				records = append(records, &FrontierRecord{Type: recordIdentityCookie, Key: name, Field: host, Data: []byte(v)})
+			}
+		}
+	}
+	s.db.mu.RUnlock()
+	for _, rec := range records {
+		if err := fn(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import 导入一批记录,访问记录保留原来的访问时间
+func (s *MemoryStore) Import(recs []*FrontierRecord) error {
+	for _, rec := range recs {
+		if err := s.importRecord(rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *MemoryStore) importRecord(rec *FrontierRecord) error {
+	switch rec.Type {
+	case recordRequest:
+		return s.PushRequest(rec.Data)
+	case recordDelayed:
+		return s.AddDelayedRequest(rec.Data, time.UnixMilli(rec.Time))
+	case recordVisited:
+		op := s.visit(rec.Member)
+		if rec.Time > 0 {
+			op.Time = rec.Time
+		}
+		s.db.mu.Lock()
+		defer s.db.mu.Unlock()
+		return s.db.apply(op)
+	case recordCookie:
+		s.SetCookies(&url.URL{Host: rec.Key}, string(rec.Data))
+		return nil
+	case recordIdentity:
+		i := &Identity{}
+		if err := json.Unmarshal(rec.Data, i); err != nil {
+			return err
+		}
+		return s.SaveIdentity(i)
+	case recordIdentityCookie:
+		s.SetIdentityCookies(rec.Key, &url.URL{Host: rec.Field}, string(rec.Data))
+		return nil
+	case recordBloom:
+		return errors.New("布隆过滤器只能导入到bloom存储器")
+	}
+	return errors.New(fmt.Sprintf("不支持的导入记录【%s】", rec.Type))
+}
+
+// QueueSize implements queue.Storage.QueueSize() function
+// 获取队列长度前将到期的延迟请求移入队列
+func (s *MemoryStore) QueueSize() (int, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	now := time.Now().UnixMilli()
+	if s.db.due(s.getDelayedID(), now) > 0 {
+		if err := s.db.apply(memoryOp{Op: opPromote, Key: s.getDelayedID(), Field: s.getQueueID(), Time: now}); err != nil {
+			return 0, err
+		}
+	}
+	return s.db.queueLen(s.getQueueID()), nil
+}
+
+func (s *MemoryStore) getCookieID() string {
+	return fmt.Sprintf("%s:cookie", s.TongsName)
+}
+
+func (s *MemoryStore) getQueueID() string {
+	return fmt.Sprintf("%s:queue", s.Id)
+}
+
+func (s *MemoryStore) getInflightID() string {
+	return fmt.Sprintf("%s:inflight", s.Id)
+}
+
+func (s *MemoryStore) getDeadLetterID() string {
+	return deadLetterKey(s.Id)
+}
+
+func (s *MemoryStore) getDelayedID() string {
+	return fmt.Sprintf("%s:delayed", s.Id)
+}
+
+func (s *MemoryStore) getVisitedID() string {
+	if Config.Bloom.Alone {
+		return fmt.Sprintf("%s:visited", s.Id)
+	} else {
+		return fmt.Sprintf("%s:visited", s.TongsName)
+	}
+}
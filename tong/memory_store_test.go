@@ -0,0 +1,372 @@
+package tong
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	Log = zap.NewNop()
+	os.Exit(m.Run())
+}
+
+func newTestMemoryStore(t *testing.T, expires time.Duration) *MemoryStore {
+	t.Helper()
+	s := &MemoryStore{Id: "test:task", TongsName: "test", IsQueue: true, Expires: expires, db: newMemoryDB()}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// testRequest 创建入队的请求,priority为空时按深度排序
+func testRequest(u string, depth int, priority ...int) []byte {
+	req := &QueuedRequest{URL: u, Method: "GET", Depth: depth}
+	if len(priority) > 0 {
+		req.Priority = &priority[0]
+	}
+	bys, _ := json.Marshal(req)
+	return bys
+}
+
+func requestURL(t *testing.T, r []byte) string {
+	t.Helper()
+	req, err := parseRequest(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.URL
+}
+
+// popAll 按出队顺序取出队列中所有请求的url
+func popAll(t *testing.T, s *MemoryStore) []string {
+	t.Helper()
+	var urls []string
+	for {
+		if n, _ := s.QueueSize(); n == 0 {
+			return urls
+		}
+		r, err := s.GetRequest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, requestURL(t, r))
+		if err := s.Ack(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func equalURLs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMemoryStoreVisited(t *testing.T) {
+	cases := []struct {
+		name    string
+		expires time.Duration
+		age     time.Duration //访问记录距今的时间
+		want    bool
+	}{
+		{"永久有效", 0, 1000 * time.Hour, true},
+		{"有效期内", time.Hour, 30 * time.Minute, true},
+		{"已过期", time.Hour, 2 * time.Hour, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestMemoryStore(t, c.expires)
+			if visited, _ := s.IsVisited(1); visited {
+				t.Fatal("未访问的请求不应存在")
+			}
+			at := time.Now().Add(-c.age).UnixMilli()
+			if err := s.db.apply(memoryOp{Op: opSAdd, Key: s.getVisitedID(), Member: 1, Time: at}); err != nil {
+				t.Fatal(err)
+			}
+			if visited, _ := s.IsVisited(1); visited != c.want {
+				t.Fatalf("IsVisited = %v, want %v", visited, c.want)
+			}
+			//定时清除只删除过期的记录
+			s.db.sweep(time.Now())
+			if _, ok := s.db.sets[s.getVisitedID()][1]; ok != c.want {
+				t.Fatalf("sweep后记录存在 = %v, want %v", ok, c.want)
+			}
+			//过期后可以再次记录访问
+			if err := s.Visited(1); err != nil {
+				t.Fatal(err)
+			}
+			if visited, _ := s.IsVisited(1); !visited {
+				t.Fatal("再次访问后应存在")
+			}
+		})
+	}
+}
+
+func TestMemoryStorePriority(t *testing.T) {
+	type add struct {
+		url      string
+		depth    int
+		priority []int
+	}
+	cases := []struct {
+		name string
+		adds []add
+		want []string
+	}{
+		{"按深度", []add{{"a", 1, nil}, {"b", 3, nil}, {"c", 2, nil}}, []string{"b", "c", "a"}},
+		{"同优先级先进先出", []add{{"a", 1, nil}, {"b", 1, nil}, {"c", 1, nil}}, []string{"a", "b", "c"}},
+		{"指定优先级", []add{{"a", 5, nil}, {"b", 1, []int{10}}, {"c", 9, []int{-1}}}, []string{"b", "a", "c"}},
+		{"重复请求去重", []add{{"a", 1, nil}, {"a", 2, nil}, {"b", 1, nil}}, []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestMemoryStore(t, 0)
+			for _, a := range c.adds {
+				if err := s.AddRequest(testRequest("http://example.com/"+a.url, a.depth, a.priority...)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var want []string
+			for _, u := range c.want {
+				want = append(want, "http://example.com/"+u)
+			}
+			if got := popAll(t, s); !equalURLs(got, want) {
+				t.Fatalf("出队顺序 %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreDelay(t *testing.T) {
+	s := newTestMemoryStore(t, 0)
+	now := time.Now()
+	adds := []struct {
+		url string
+		at  time.Time
+	}{
+		{"http://example.com/later", now.Add(time.Hour)},
+		{"http://example.com/due", now.Add(-time.Second)},
+	}
+	for _, a := range adds {
+		if err := s.AddDelayedRequest(testRequest(a.url, 1), a.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := s.DelayedSize(); n != 2 {
+		t.Fatalf("DelayedSize = %d, want 2", n)
+	}
+	//获取队列长度时只移入到期的请求
+	if n, _ := s.QueueSize(); n != 1 {
+		t.Fatalf("QueueSize = %d, want 1", n)
+	}
+	if n, _ := s.DelayedSize(); n != 1 {
+		t.Fatalf("DelayedSize = %d, want 1", n)
+	}
+	if got := popAll(t, s); !equalURLs(got, []string{"http://example.com/due"}) {
+		t.Fatalf("出队 %v", got)
+	}
+}
+
+func TestMemoryStoreAck(t *testing.T) {
+	cases := []struct {
+		name         string
+		settle       func(s *MemoryStore, r []byte) error
+		wantInflight int
+		want         []string //处理后按出队顺序的队列
+	}{
+		{"确认", func(s *MemoryStore, r []byte) error {
+			return s.Ack(r)
+		}, 0, []string{"http://example.com/b"}},
+		{"放回保持原顺序", func(s *MemoryStore, r []byte) error {
+			return s.Release(r)
+		}, 0, []string{"http://example.com/a", "http://example.com/b"}},
+		{"未超时不回收", func(s *MemoryStore, r []byte) error {
+			_, err := s.Reclaim()
+			return err
+		}, 1, []string{"http://example.com/b"}},
+		{"超时回收", func(s *MemoryStore, r []byte) error {
+			s.db.inflight[s.getInflightID()][string(r)].Deadline = time.Now().Add(-time.Second).UnixMilli()
+			n, err := s.Reclaim()
+			if err == nil && n != 1 {
+				err = fmt.Errorf("Reclaim = %d, want 1", n)
+			}
+			return err
+		}, 0, []string{"http://example.com/a", "http://example.com/b"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestMemoryStore(t, 0)
+			for _, u := range []string{"http://example.com/a", "http://example.com/b"} {
+				if err := s.AddRequest(testRequest(u, 1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			r, err := s.GetRequest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := s.InflightSize(); n != 1 {
+				t.Fatalf("InflightSize = %d, want 1", n)
+			}
+			if err := c.settle(s, r); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := s.InflightSize(); n != c.wantInflight {
+				t.Fatalf("InflightSize = %d, want %d", n, c.wantInflight)
+			}
+			if got := popAll(t, s); !equalURLs(got, c.want) {
+				t.Fatalf("出队顺序 %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStorePeekRequests(t *testing.T) {
+	s := newTestMemoryStore(t, 0)
+	for i := 0; i < 30; i++ {
+		if err := s.AddRequest(testRequest(fmt.Sprintf("http://example.com/%d", i), i%4, i%7)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var all []string
+	for offset := 0; ; offset += 7 {
+		page, err := s.PeekRequests(offset, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page) == 0 {
+			break
+		}
+		for _, r := range page {
+			all = append(all, requestURL(t, r))
+		}
+	}
+	if n, _ := s.QueueSize(); n != 30 {
+		t.Fatalf("查看后QueueSize = %d, want 30", n)
+	}
+	if got := popAll(t, s); !equalURLs(all, got) {
+		t.Fatalf("分页查看顺序 %v 与出队顺序 %v 不一致", all, got)
+	}
+
+	cases := []struct {
+		name      string
+		size      int
+		offset, n int
+		want      int
+	}{
+		{"超出队列长度", 3, 3, 10, 0},
+		{"最后一页", 5, 3, 10, 2},
+		{"限制单页数量", maxPeekSize + 10, 0, maxPeekSize + 10, maxPeekSize},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestMemoryStore(t, 0)
+			for i := 0; i < c.size; i++ {
+				if err := s.PushRequest(testRequest(fmt.Sprintf("http://example.com/%d", i), 1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			page, err := s.PeekRequests(c.offset, c.n)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(page) != c.want {
+				t.Fatalf("PeekRequests返回%d个, want %d", len(page), c.want)
+			}
+		})
+	}
+}
+
+func TestMemoryStoreResetCookies(t *testing.T) {
+	s := newTestMemoryStore(t, 0)
+	u := &url.URL{Host: "example.com"}
+	s.SetCookies(u, "a=1")
+	if err := s.SaveIdentity(&Identity{Name: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	s.SetIdentityCookies("u1", u, "s=1")
+	//已删除账号残留的cookie
+	s.SetIdentityCookies("u2", u, "s=2")
+	if err := s.Reset(ResetCookies); err != nil {
+		t.Fatal(err)
+	}
+	if c := s.Cookies(u); c != "" {
+		t.Fatalf("cookie未清除: %s", c)
+	}
+	if ids, _ := s.Identities(); len(ids) != 0 {
+		t.Fatalf("账号未清除: %d", len(ids))
+	}
+	for _, name := range []string{"u1", "u2"} {
+		if c := s.IdentityCookies(name, u); c != "" {
+			t.Fatalf("账号【%s】cookie未清除: %s", name, c)
+		}
+	}
+}
+
+func TestMemoryStoreVisit(t *testing.T) {
+	s := newTestMemoryStore(t, time.Hour)
+	const workers = 20
+	results := make(chan bool, workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			visited, err := s.Visit(7)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- visited
+		}()
+	}
+	first := 0
+	for i := 0; i < workers; i++ {
+		if !<-results {
+			first++
+		}
+	}
+	if first != 1 {
+		t.Fatalf("%d个并发访问返回未访问, want 1", first)
+	}
+}
+
+func TestMemoryStoreClose(t *testing.T) {
+	db := newMemoryDB()
+	var stores []*MemoryStore
+	for _, name := range []string{"a", "b"} {
+		s := &MemoryStore{Id: "test:" + name, TongsName: "test", Expires: time.Hour, db: db}
+		if err := s.Init(); err != nil {
+			t.Fatal(err)
+		}
+		stores = append(stores, s)
+	}
+	stores[0].Close()
+	if db.sweeper == nil {
+		t.Fatal("仍有存储器使用时不应停止定时清除")
+	}
+	stores[1].Close()
+	if db.sweeper != nil {
+		t.Fatal("全部关闭后应停止定时清除")
+	}
+	//重复关闭不影响再次打开的存储器
+	s := &MemoryStore{Id: "test:c", TongsName: "test", Expires: time.Hour, db: db}
+	if err := s.Init(); err != nil {
+		t.Fatal(err)
+	}
+	stores[1].Close()
+	if db.sweeper == nil {
+		t.Fatal("再次打开后应重新开始定时清除")
+	}
+	s.Close()
+}
@@ -0,0 +1,87 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// KeyStore 支持列出所属key的存储器
+type KeyStore interface {
+	// Keys 获取存储器所在Tongs在redis中的所有key
+	Keys() ([]string, error)
+}
+
+// keyPrefix 按 配置文件namespaces > 代码设置 > 全局配置 的顺序选择key前缀
+func keyPrefix(t *Tongs) string {
+	for _, n := range Config.Namespaces {
+		if n.Tongs == t.Name && n.KeyPrefix != "" {
+			return n.KeyPrefix
+		}
+	}
+	if t.KeyPrefix != "" {
+		return t.KeyPrefix
+	}
+	return Config.KeyPrefix
+}
+
+// Keys 获取Tongs在redis中的所有key,包括所有任务的队列、访问记录、cookie等
+func (t *Tongs) Keys() ([]string, error) {
+	seen := make(map[string]bool)
+	keys := make([]string, 0)
+	supported := false
+	for _, task := range t.Tasks {
+		s, ok := task.store.(KeyStore)
+		if !ok {
+			continue
+		}
+		supported = true
+		batch, err := s.Keys()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	if !supported {
+		return nil, errors.New(fmt.Sprintf("【%s】内没有使用redis存储器的任务", t.Name))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// redisKeys 获取Tongs的所有key,Tongs内共用的布隆过滤器使用Tongs ID作为key
+func redisKeys(c redis.UniversalClient, tongs string) ([]string, error) {
+	keys, err := scanKeys(c, escapeGlob(tongs)+":*")
+	if err != nil {
+		return nil, err
+	}
+	n, err := c.Exists(tongs).Result()
+	if err != nil {
+		return nil, err
+	}
+	if n > 0 {
+		keys = append(keys, tongs)
+	}
+	return keys, nil
+}
+
+// escapeGlob 转义SCAN匹配中的特殊字符
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
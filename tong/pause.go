@@ -0,0 +1,77 @@
+package tong
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pauseGate 普通任务的暂停开关,暂停时新请求在发出前等待,已发出的请求继续执行
+type pauseGate struct {
+	mu     sync.Mutex
+	paused bool
+	resume chan struct{}
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.paused {
+		g.paused = true
+		g.resume = make(chan struct{})
+	}
+}
+
+// open 恢复或停止时放行所有等待中的请求
+func (g *pauseGate) open() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.paused {
+		g.paused = false
+		close(g.resume)
+	}
+}
+
+func (g *pauseGate) wait() {
+	g.mu.Lock()
+	if !g.paused {
+		g.mu.Unlock()
+		return
+	}
+	resume := g.resume
+	g.mu.Unlock()
+	<-resume
+}
+
+// Pause 暂停任务,不再发出新请求,已发出的请求继续执行,队列和访问记录保持不变
+// 队列任务在执行中的请求完成后由暂停中变为已暂停
+func (t *Task) Pause() error {
+	if err := t.setStatus(StatusPausing, ""); err != nil {
+		return err
+	}
+	if t.IsQueue {
+		t.queue.Pause()
+		return nil
+	}
+	t.gate.pause()
+	if err := t.setStatus(StatusPaused, ""); err != nil {
+		//暂停过程中被停止
+		t.gate.open()
+		return err
+	}
+	Log.Info(fmt.Sprintf("普通任务【%s-%s】已暂停", t.tongs.Name, t.Name))
+	return nil
+}
+
+// Resume 恢复暂停的任务,从暂停时的队列继续执行
+func (t *Task) Resume() error {
+	if err := t.setStatus(StatusRunning, "恢复"); err != nil {
+		return err
+	}
+	if t.IsQueue {
+		t.queue.Resume()
+	} else {
+		t.gate.open()
+	}
+	Log.Info(fmt.Sprintf("任务【%s-%s】已恢复", t.tongs.Name, t.Name))
+	return nil
+}
@@ -0,0 +1,505 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// AckStore 支持请求确认的存储器
+// 出队的请求在确认前保存在处理中列表,超过确认超时时间仍未确认的请求会被重新放回队列,
+// 进程在请求处理过程中退出时请求不会丢失
+type AckStore interface {
+	// Ack 请求处理完成后确认,从处理中列表移除
+	Ack(r []byte) error
+	// Reclaim 将确认超时的请求重新放回队列,返回放回的数量
+	Reclaim() (int, error)
+}
+
+// ReleaseStore 支持将处理中的请求立即放回队列的存储器,用于进程退出前归还已出队但未处理完的请求
+type ReleaseStore interface {
+	// Release 将处理中的请求按原优先级放回队列,已确认的请求忽略
+	Release(r []byte) error
+}
+
+// DelayStore 支持延迟请求的存储器,延迟请求到期后在获取队列长度时移入队列
+type DelayStore interface {
+	// AddDelayedRequest 添加到期后才进入队列的请求
+	AddDelayedRequest(r []byte, at time.Time) error
+	// DelayedSize 等待到期的延迟请求数量
+	DelayedSize() (int, error)
+}
+
+// CompletionStore 支持跨进程判断队列是否完成的存储器
+type CompletionStore interface {
+	// InflightSize 所有进程已出队但未确认的请求数量
+	InflightSize() (int, error)
+}
+
+// delayPollInterval 等待延迟请求到期或其他进程完成请求时检查队列的间隔,获取请求失败时也等待该间隔后重试
+const delayPollInterval = time.Second
+
+// errQueueEmpty 队列为空,获取队列长度后请求被其他进程取走时出现
+var errQueueEmpty = errors.New("queue is empty")
+
+// visibilityTimeout 出队请求的确认超时时间
+func visibilityTimeout() time.Duration {
+	if Config.Store.VisibilityTimeout > 0 {
+		return time.Duration(Config.Store.VisibilityTimeout) * time.Second
+	}
+	return 10 * time.Minute
+}
+
+// Queue 队列任务的请求队列,使用多个线程从存储器中取出请求交给Collector执行
+// 与colly的queue.Queue逻辑一致,区别在于请求的回调全部执行完成后才向存储器确认
+type Queue struct {
+	Threads     int
+	IdleTimeout time.Duration //队列为空且所有进程都没有处理中的请求后,再等待多久没有新请求才结束
+	storage     Store
+	wake        chan struct{}
+	mut         sync.Mutex // guards wake, running and paused
+	running     bool
+	paused      bool     //暂停时不再出队,已出队的请求继续执行
+	inflight    sync.Map //执行中的请求 *queueItem -> struct{}
+	onPaused    func()   //暂停后执行中的请求全部完成时调用
+	name        string   //日志中的任务名称
+}
+
+// queueItem 从存储器中取出的请求及其原始内容,原始内容用于确认
+type queueItem struct {
+	req *colly.Request
+	raw []byte
+}
+
+// NewQueue 创建队列,threads小于1时使用单线程
+func NewQueue(threads int, s Store) (*Queue, error) {
+	if err := s.Init(); err != nil {
+		return nil, err
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	return &Queue{
+		Threads: threads,
+		storage: s,
+		running: true,
+	}, nil
+}
+
+// AddURL adds a new URL to the queue
+func (q *Queue) AddURL(URL string) error {
+	u, err := urlParser.Parse(URL)
+	if err != nil {
+		return err
+	}
+	u2, err := url.Parse(u.Href(false))
+	if err != nil {
+		return err
+	}
+	r := &colly.Request{
+		URL:    u2,
+		Method: "GET",
+	}
+	return q.AddRequest(r)
+}
+
+// AddRequest adds a new Request to the queue
+func (q *Queue) AddRequest(r *colly.Request) error {
+	return q.addRequest(r, nil)
+}
+
+// AddRequestWithPriority 添加指定优先级的请求,优先级只属于该请求,子请求仍使用请求深度作为优先级
+// 优先级的绝对值超过MaxPriority时返回错误
+func (q *Queue) AddRequestWithPriority(r *colly.Request, priority int) error {
+	return q.addRequest(r, &priority)
+}
+
+func (q *Queue) addRequest(r *colly.Request, priority *int) error {
+	if priority != nil {
+		if err := checkPriority(*priority); err != nil {
+			return err
+		}
+	}
+	d, err := marshalRequest(r, priority)
+	if err != nil {
+		return err
+	}
+	if err := q.storage.AddRequest(d); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// AddRequestAt 添加在at之后才执行的请求,延迟请求不做去重
+func (q *Queue) AddRequestAt(r *colly.Request, at time.Time) error {
+	s, ok := q.storage.(DelayStore)
+	if !ok {
+		return errors.New("当前存储器不支持延迟请求")
+	}
+	d, err := marshalRequest(r, nil)
+	if err != nil {
+		return err
+	}
+	if err := s.AddDelayedRequest(d, at); err != nil {
+		return err
+	}
+	q.notify()
+	return nil
+}
+
+// hasDelayed 是否还有等待到期的延迟请求
+func (q *Queue) hasDelayed() bool {
+	s, ok := q.storage.(DelayStore)
+	if !ok {
+		return false
+	}
+	n, err := s.DelayedSize()
+	if err != nil {
+		Log.Error(fmt.Sprintf("获取延迟请求数量失败, err:%s", err.Error()))
+		return false
+	}
+	return n > 0
+}
+
+// notify 唤醒正在等待的调度循环
+func (q *Queue) notify() {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	if q.wake == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Size returns the size of the queue
+func (q *Queue) Size() (int, error) {
+	return q.storage.QueueSize()
+}
+
+// IsEmpty returns true if the queue is empty
+func (q *Queue) IsEmpty() bool {
+	s, _ := q.Size()
+	return s == 0
+}
+
+// Run starts consumer threads and calls the Collector
+// to perform requests. Run blocks while the queue has active requests
+func (q *Queue) Run(c *colly.Collector) error {
+	if c.Async {
+		//请求在所有回调完成后才确认,异步collector的Do会在回调完成前返回
+		return errors.New("队列不支持异步collector")
+	}
+	q.mut.Lock()
+	if q.wake != nil {
+		q.mut.Unlock()
+		return errors.New("队列正在运行")
+	}
+	q.wake = make(chan struct{}, 1)
+	q.running = true
+	q.mut.Unlock()
+	defer func() {
+		q.mut.Lock()
+		q.wake = nil
+		q.mut.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	q.reclaim()
+	go q.reaper(done)
+
+	requestc := make(chan *queueItem)
+	//队列停止后仍在执行的请求完成时不会阻塞
+	complete, errc := make(chan struct{}, q.Threads), make(chan error, 1)
+	for i := 0; i < q.Threads; i++ {
+		go q.runner(requestc, complete)
+	}
+	go q.loop(c, requestc, complete, errc)
+	defer close(requestc)
+	return <-errc
+}
+
+// Stop will stop the running queue
+func (q *Queue) Stop() {
+	q.mut.Lock()
+	q.running = false
+	q.mut.Unlock()
+	q.notify()
+}
+
+// Pause 暂停出队,已出队的请求继续执行并确认,队列内容保持不变
+func (q *Queue) Pause() {
+	q.mut.Lock()
+	q.paused = true
+	q.mut.Unlock()
+	q.notify()
+}
+
+// Resume 恢复出队
+func (q *Queue) Resume() {
+	q.mut.Lock()
+	q.paused = false
+	q.mut.Unlock()
+	q.notify()
+}
+
+func (q *Queue) isPaused() bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.paused
+}
+
+func (q *Queue) isRunning() bool {
+	q.mut.Lock()
+	defer q.mut.Unlock()
+	return q.running
+}
+
+func (q *Queue) loop(c *colly.Collector, requestc chan<- *queueItem, complete <-chan struct{}, errc chan<- error) {
+	var active int
+	var idleSince time.Time
+	var paused bool
+	for {
+		size, err := q.storage.QueueSize()
+		if err != nil {
+			errc <- err
+			break
+		}
+		if !q.isRunning() {
+			//等待执行中的请求完成并确认后再结束
+			for ; active > 0; active-- {
+				<-complete
+			}
+			errc <- nil
+			break
+		}
+		if q.isPaused() {
+			//暂停时只等待执行中的请求完成,恢复或停止时唤醒
+			if active == 0 && !paused {
+				paused = true
+				if q.onPaused != nil {
+					q.onPaused()
+				}
+			}
+			select {
+			case <-q.wake:
+			case <-complete:
+				active--
+			}
+			continue
+		}
+		paused = false
+		if size == 0 && active == 0 {
+			// Terminate when
+			//   1. No active requests
+			//   2. Emtpy queue
+			//   3. No delayed requests
+			//   4. No inflight requests on other workers
+			//   5. Idle timeout elapsed
+			if idleSince.IsZero() {
+				idleSince = time.Now()
+			}
+			if !q.hasDelayed() && q.idle(idleSince) {
+				errc <- nil
+				break
+			}
+			select {
+			case <-q.wake:
+			case <-time.After(delayPollInterval):
+			}
+			continue
+		}
+		sent := requestc
+		var item *queueItem
+		if size > 0 {
+			item, err = q.loadRequest(c)
+			if err == errQueueEmpty {
+				continue
+			}
+			if err != nil {
+				//存储器不可用时等待后重试,避免反复请求存储器
+				Log.Error(fmt.Sprintf("任务【%s】获取请求失败, err:%s", q.name, err.Error()))
+				select {
+				case <-q.wake:
+				case <-time.After(delayPollInterval):
+				}
+				continue
+			}
+			if item == nil {
+				continue
+			}
+		} else {
+			sent = nil
+		}
+	Sent:
+		for {
+			select {
+			case sent <- item:
+				active++
+				idleSince = time.Time{}
+				break Sent
+			case <-q.wake:
+				if sent == nil {
+					break Sent
+				}
+				if !q.isRunning() {
+					//已出队但还没有交给线程执行的请求放回队列
+					q.release(item.raw)
+					break Sent
+				}
+			case <-complete:
+				active--
+				if sent == nil && active == 0 {
+					break Sent
+				}
+			case <-delayTicker(sent == nil):
+				//队列为空时定时检查是否有到期的延迟请求
+				break Sent
+			}
+		}
+	}
+}
+
+// idle 其他进程没有处理中的请求且空闲超过IdleTimeout,其他进程处理中的请求可能会添加新的请求
+// 进程退出后未确认的请求在确认超时后由主进程的reaper放回队列
+func (q *Queue) idle(since time.Time) bool {
+	//只读检查,所有进程都要等待其他进程处理中的请求完成后才能结束
+	if s, ok := q.storage.(CompletionStore); ok {
+		n, err := s.InflightSize()
+		if err != nil {
+			Log.Error(fmt.Sprintf("获取处理中请求数量失败, err:%s", err.Error()))
+			return false
+		}
+		if n > 0 {
+			return false
+		}
+	}
+	return time.Since(since) >= q.IdleTimeout
+}
+
+func delayTicker(wait bool) <-chan time.Time {
+	if !wait {
+		return nil
+	}
+	return time.After(delayPollInterval)
+}
+
+func (q *Queue) runner(requestc <-chan *queueItem, complete chan<- struct{}) {
+	for item := range requestc {
+		q.inflight.Store(item, struct{}{})
+		//Run拒绝异步collector,Do返回时回调已执行完成
+		item.req.Do()
+		q.ack(item.raw)
+		q.inflight.Delete(item)
+		complete <- struct{}{}
+	}
+}
+
+// loadRequest 取出请求,无法解析的请求确认后丢弃并返回nil
+func (q *Queue) loadRequest(c *colly.Collector) (*queueItem, error) {
+	buf, err := q.storage.GetRequest()
+	if err != nil {
+		return nil, err
+	}
+	copied := make([]byte, len(buf))
+	copy(copied, buf)
+	req, err := c.UnmarshalRequest(copied)
+	if err != nil {
+		//无法解析的请求直接确认,避免被反复放回队列
+		Log.Error(fmt.Sprintf("任务【%s】请求解析失败,已丢弃, err:%s", q.name, err.Error()))
+		q.ack(buf)
+		return nil, nil
+	}
+	if queued, err := parseRequest(buf); err == nil && (queued.Priority != nil || queued.Ctx[PriorityKey] != nil) {
+		//指定的优先级按url保存在上下文中,延迟重试时重新写入请求,旧请求上下文中的优先级清除后不再被子请求继承
+		req.Ctx.Put(priorityKey(req), queued.priority())
+		req.Ctx.Put(PriorityKey, nil)
+	}
+	return &queueItem{req: req, raw: buf}, nil
+}
+
+func (q *Queue) ack(raw []byte) {
+	if s, ok := q.storage.(AckStore); ok {
+		if err := s.Ack(raw); err != nil {
+			Log.Error(fmt.Sprintf("请求确认失败, err:%s", err.Error()))
+		}
+	}
+}
+
+// release 将出队的请求放回队列,存储器不支持时等待确认超时后由reaper放回
+func (q *Queue) release(raw []byte) {
+	if s, ok := q.storage.(ReleaseStore); ok {
+		if err := s.Release(raw); err != nil {
+			Log.Error(fmt.Sprintf("请求放回队列失败, err:%s", err.Error()))
+		}
+	}
+}
+
+// releaseInflight 将执行中的请求全部放回队列,返回放回的数量,用于关闭超时后不再等待执行中的请求
+// 之后请求完成时的确认不会再从队列中删除已放回的请求,该请求可能被再次执行
+func (q *Queue) releaseInflight() int {
+	n := 0
+	q.inflight.Range(func(key, value interface{}) bool {
+		q.release(key.(*queueItem).raw)
+		q.inflight.Delete(key)
+		n++
+		return true
+	})
+	return n
+}
+
+// reclaim 将确认超时的请求放回队列,包括其他进程取出后未确认的请求
+func (q *Queue) reclaim() {
+	s, ok := q.storage.(AckStore)
+	if !ok {
+		return
+	}
+	//多进程共用队列时只由主进程回收
+	if q.shared() && !IsLeader() {
+		return
+	}
+	n, err := s.Reclaim()
+	if err != nil {
+		Log.Error(fmt.Sprintf("回收超时请求失败, err:%s", err.Error()))
+		return
+	}
+	if n > 0 {
+		Log.Info(fmt.Sprintf("回收超时请求%d个", n))
+		q.notify()
+	}
+}
+
+// shared 存储器是否在redis中被多个进程共用
+func (q *Queue) shared() bool {
+	_, ok := q.storage.(KeyStore)
+	return ok
+}
+
+// reaper 队列运行期间定时回收超时请求
+func (q *Queue) reaper(done <-chan struct{}) {
+	if _, ok := q.storage.(AckStore); !ok {
+		return
+	}
+	interval := visibilityTimeout() / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			q.reclaim()
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package tong
+
+import (
+	"errors"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+func TestQueuePriorityRange(t *testing.T) {
+	cases := []struct {
+		name     string
+		priority int
+		wantErr  bool
+	}{
+		{"最高优先级", MaxPriority, false},
+		{"最低优先级", -MaxPriority, false},
+		{"超出上限", MaxPriority + 1, true},
+		{"超出下限", -MaxPriority - 1, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			q, err := NewQueue(1, newTestMemoryStore(t, 0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse("http://example.com/")
+			err = q.AddRequestWithPriority(&colly.Request{URL: u, Method: "GET"}, c.priority)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("AddRequestWithPriority err = %v, wantErr %v", err, c.wantErr)
+			}
+		})
+	}
+}
+
+// unavailableStore 队列不为空但获取请求总是失败的存储器
+type unavailableStore struct {
+	*MemoryStore
+	gets int64
+}
+
+func (s *unavailableStore) QueueSize() (int, error) {
+	return 1, nil
+}
+
+func (s *unavailableStore) GetRequest() ([]byte, error) {
+	atomic.AddInt64(&s.gets, 1)
+	return nil, errors.New("connection refused")
+}
+
+func TestQueueLoadBackoff(t *testing.T) {
+	s := &unavailableStore{MemoryStore: newTestMemoryStore(t, 0)}
+	q, err := NewQueue(1, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() {
+		done <- q.Run(colly.NewCollector())
+	}()
+	time.Sleep(delayPollInterval + delayPollInterval/2)
+	q.Stop()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	//获取失败后等待delayPollInterval再重试
+	if gets := atomic.LoadInt64(&s.gets); gets > 3 {
+		t.Fatalf("获取请求%d次, 失败后应等待后重试", gets)
+	}
+}
@@ -0,0 +1,251 @@
+package tong
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// redis中的优先级队列,TongsStore和BloomStore共用
+// 队列使用有序集合,score = -优先级*1e10 + 序号,优先级高的先出队,同优先级先进先出
+// 优先级的绝对值不超过MaxPriority,score在float64中可以精确表示,序号每1e10个请求循环一次
+// 成员为加入随机Nonce的请求内容,内容相同的请求不会合并
+// 旧版本使用list保存队列,出队时在有序集合为空后继续消费旧队列
+// 入队脚本在事务管道中执行,不能使用EVALSHA,所以只保留脚本内容
+const pushScript = `
+local seq = redis.call('INCR', KEYS[2]) % 10000000000
+redis.call('ZADD', KEYS[1], 'NX', -tonumber(ARGV[2]) * 10000000000 + seq, ARGV[1])
+return seq`
+
+var (
+	// 出队时将请求移入处理中集合,score为确认截止时间,同时记录请求在队列中的score,回收时按原优先级放回
+	popScript = redis.NewScript(`
+local r = redis.call('ZRANGE', KEYS[1], 0, 0, 'WITHSCORES')
+local member, score
+if r[1] then
+	member = r[1]
+	score = r[2]
+	redis.call('ZREM', KEYS[1], member)
+else
+	member = redis.call('LPOP', KEYS[2])
+	if not member then
+		return false
+	end
+	score = '0'
+end
+redis.call('ZADD', KEYS[3], ARGV[1], member)
+redis.call('HSET', KEYS[4], member, score)
+return member`)
+	// 将到期的延迟请求按优先级移入队列,返回队列长度
+	sizeScript = redis.NewScript(`
+local due = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1000)
+for _, member in ipairs(due) do
+	local priority = redis.call('HGET', KEYS[2], member) or '0'
+	local seq = redis.call('INCR', KEYS[3]) % 10000000000
+	redis.call('ZADD', KEYS[4], 'NX', -tonumber(priority) * 10000000000 + seq, member)
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('HDEL', KEYS[2], member)
+end
+return redis.call('ZCARD', KEYS[4]) + redis.call('LLEN', KEYS[5])`)
+	reclaimScript = redis.NewScript(`
+local members = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1000)
+for _, member in ipairs(members) do
+	local score = redis.call('HGET', KEYS[2], member) or '0'
+	redis.call('ZADD', KEYS[3], score, member)
+	redis.call('ZREM', KEYS[1], member)
+	redis.call('HDEL', KEYS[2], member)
+end
+return #members`)
+	releaseScript = redis.NewScript(`
+if redis.call('ZREM', KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+local score = redis.call('HGET', KEYS[2], ARGV[1]) or '0'
+redis.call('ZADD', KEYS[3], score, ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+return 1`)
+)
+
+// redisPush 请求入队,可以传入事务管道与其他命令一起执行
+func redisPush(c redis.Cmdable, id string, r []byte) error {
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := checkPriority(req.priority()); err != nil {
+		return err
+	}
+	member, err := queueMember(r)
+	if err != nil {
+		return err
+	}
+	return c.Eval(pushScript, []string{queueKey(id), queueSeqKey(id)}, member, req.priority()).Err()
+}
+
+// redisPop 请求出队并移入处理中集合,需要在处理完成后调用redisAck确认
+func redisPop(c redis.UniversalClient, id string) ([]byte, error) {
+	deadline := time.Now().Add(visibilityTimeout()).UnixMilli()
+	keys := []string{queueKey(id), legacyQueueKey(id), inflightKey(id), inflightScoreKey(id)}
+	r, err := popScript.Run(c, keys, deadline).String()
+	if err == redis.Nil {
+		return nil, errQueueEmpty
+	} else if err != nil {
+		return nil, err
+	}
+	return []byte(r), nil
+}
+
+func redisAck(c redis.UniversalClient, id string, r []byte) error {
+	_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.ZRem(inflightKey(id), r)
+		pipe.HDel(inflightScoreKey(id), string(r))
+		return nil
+	})
+	return err
+}
+
+// redisReclaim 将确认超时的请求放回队列,每次最多回收1000个
+func redisReclaim(c redis.UniversalClient, id string) (int, error) {
+	keys := []string{inflightKey(id), inflightScoreKey(id), queueKey(id)}
+	n, err := reclaimScript.Run(c, keys, time.Now().UnixMilli()).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+// redisRelease 将处理中的请求按原优先级放回队列
+func redisRelease(c redis.UniversalClient, id string, r []byte) error {
+	keys := []string{inflightKey(id), inflightScoreKey(id), queueKey(id)}
+	return releaseScript.Run(c, keys, r).Err()
+}
+
+// redisQueueSize 获取队列长度,同时将到期的延迟请求移入队列
+func redisQueueSize(c redis.UniversalClient, id string) (int, error) {
+	keys := []string{delayedKey(id), delayedPriorityKey(id), queueSeqKey(id), queueKey(id), legacyQueueKey(id)}
+	return sizeScript.Run(c, keys, time.Now().UnixMilli()).Int()
+}
+
+// redisPushDelayed 添加延迟请求,到期前保存在延迟集合中,score为到期时间
+func redisPushDelayed(c redis.UniversalClient, id string, r []byte, at time.Time) error {
+	_, err := c.TxPipelined(func(pipe redis.Pipeliner) error {
+		return redisDelayed(pipe, id, r, at)
+	})
+	return err
+}
+
+// redisDelayed 将添加延迟请求的命令写入管道
+func redisDelayed(pipe redis.Pipeliner, id string, r []byte, at time.Time) error {
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := checkPriority(req.priority()); err != nil {
+		return err
+	}
+	member, err := queueMember(r)
+	if err != nil {
+		return err
+	}
+	pipe.ZAdd(delayedKey(id), redis.Z{Score: float64(at.UnixMilli()), Member: member})
+	pipe.HSet(delayedPriorityKey(id), string(member), req.priority())
+	return nil
+}
+
+func redisDelayedSize(c redis.UniversalClient, id string) (int, error) {
+	n, err := c.ZCard(delayedKey(id)).Result()
+	return int(n), err
+}
+
+// redisInflightSize 处理中集合由所有进程共用,可以用来判断其他进程是否还有未完成的请求
+func redisInflightSize(c redis.UniversalClient, id string) (int, error) {
+	n, err := c.ZCard(inflightKey(id)).Result()
+	return int(n), err
+}
+
+// redisPeek 按出队顺序获取从offset开始的最多n个请求,有序集合之后是旧版本的list队列
+func redisPeek(c redis.UniversalClient, id string, offset, n int) ([][]byte, error) {
+	if n > maxPeekSize {
+		n = maxPeekSize
+	}
+	zsize, err := c.ZCard(queueKey(id)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	if int64(offset) < zsize {
+		members, err = c.ZRange(queueKey(id), int64(offset), int64(offset+n-1)).Result()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(members) < n {
+		start := int64(offset) - zsize
+		if start < 0 {
+			start = 0
+		}
+		legacy, err := c.LRange(legacyQueueKey(id), start, start+int64(n-len(members))-1).Result()
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, legacy...)
+	}
+	requests := make([][]byte, len(members))
+	for i, m := range members {
+		requests[i] = []byte(m)
+	}
+	return requests, nil
+}
+
+// redisRemove 从队列中删除请求
+func redisRemove(c redis.UniversalClient, id string, r []byte) (bool, error) {
+	n, err := c.ZRem(queueKey(id), r).Result()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		n, err = c.LRem(legacyQueueKey(id), 1, r).Result()
+		if err != nil {
+			return false, err
+		}
+	}
+	return n > 0, nil
+}
+
+// redisQueueKeys 任务队列相关的所有key
+func redisQueueKeys(id string) []string {
+	return []string{
+		queueKey(id), queueSeqKey(id), legacyQueueKey(id),
+		inflightKey(id), inflightScoreKey(id),
+		delayedKey(id), delayedPriorityKey(id),
+	}
+}
+
+func queueKey(id string) string {
+	return fmt.Sprintf("%s:pqueue", id)
+}
+
+func queueSeqKey(id string) string {
+	return fmt.Sprintf("%s:pqueue:seq", id)
+}
+
+func legacyQueueKey(id string) string {
+	return fmt.Sprintf("%s:queue", id)
+}
+
+func inflightKey(id string) string {
+	return fmt.Sprintf("%s:inflight", id)
+}
+
+func inflightScoreKey(id string) string {
+	return fmt.Sprintf("%s:inflight:score", id)
+}
+
+func delayedKey(id string) string {
+	return fmt.Sprintf("%s:delayed", id)
+}
+
+func delayedPriorityKey(id string) string {
+	return fmt.Sprintf("%s:delayed:priority", id)
+}
@@ -0,0 +1,97 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// PriorityKey 请求优先级在上下文中的key
+// Deprecated: 上下文由子请求共用,优先级会被所有子请求继承,请使用AddRequestWithPriority,仅用于兼容已入队的旧请求
+const PriorityKey = "tongs:priority"
+
+// MaxPriority 优先级绝对值的上限
+// redis队列的score为 -优先级*1e10+序号,超出后float64无法精确表示序号,同优先级的请求不再先进先出
+const MaxPriority = 900000
+
+// QueuedRequest 存储器中序列化的请求,字段与colly序列化的请求保持一致,用于计算指纹和优先级
+type QueuedRequest struct {
+	URL      string
+	Method   string
+	Depth    int
+	Body     []byte
+	Ctx      map[string]interface{}
+	Headers  http.Header
+	Priority *int `json:",omitempty"` //指定的优先级,只属于当前请求,子请求不继承
+}
+
+func parseRequest(r []byte) (*QueuedRequest, error) {
+	req := &QueuedRequest{}
+	if err := json.Unmarshal(r, req); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// priority 获取请求优先级,默认越深的请求越先执行,使详情页不必等待分页全部入队后才开始
+func (r *QueuedRequest) priority() int {
+	if r.Priority != nil {
+		return *r.Priority
+	}
+	if p, ok := r.Ctx[PriorityKey].(float64); ok {
+		return int(p)
+	}
+	return r.Depth
+}
+
+// checkPriority 优先级超出范围时返回错误
+func checkPriority(priority int) error {
+	if priority > MaxPriority || priority < -MaxPriority {
+		return errors.New(fmt.Sprintf("优先级【%d】超出范围【%d, %d】", priority, -MaxPriority, MaxPriority))
+	}
+	return nil
+}
+
+// priorityKey 出队后请求指定的优先级在上下文中的key,按url区分,重试时保留优先级且不会被子请求继承
+func priorityKey(r *colly.Request) string {
+	return PriorityKey + ":" + r.URL.String()
+}
+
+// marshalRequest 序列化请求,priority为空时使用出队时保存在上下文中的优先级
+func marshalRequest(r *colly.Request, priority *int) ([]byte, error) {
+	d, err := r.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if priority == nil && r.Ctx != nil {
+		if p, ok := r.Ctx.GetAny(priorityKey(r)).(int); ok {
+			priority = &p
+		}
+	}
+	if priority == nil {
+		return d, nil
+	}
+	return setRequestField(d, "Priority", *priority)
+}
+
+// queueMember 请求在队列中的内容,加入随机的Nonce,使内容相同的请求在有序集合和处理中集合中不会合并为一个,已有的Nonce会被替换
+func queueMember(r []byte) ([]byte, error) {
+	return setRequestField(r, "Nonce", fmt.Sprintf("%016x", rand.Uint64()))
+}
+
+func setRequestField(r []byte, name string, value interface{}) ([]byte, error) {
+	fields := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(r, &fields); err != nil {
+		return nil, err
+	}
+	v, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	fields[name] = v
+	return json.Marshal(fields)
+}
@@ -0,0 +1,63 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ResetOption 重置存储器的内容,可以组合使用
+type ResetOption int
+
+const (
+	ResetQueue   ResetOption = 1 << iota //队列,包括等待中、处理中和延迟的请求
+	ResetVisited                         //访问记录或布隆过滤器,Tongs内共用时只能重置整个Tongs
+	ResetCookies                         //cookie和账号及账号的cookie,同一个Tongs内的任务共用,只能重置整个Tongs
+	ResetAll     = ResetQueue | ResetVisited | ResetCookies
+)
+
+var resetOptions = map[string]ResetOption{
+	"queue":   ResetQueue,
+	"visited": ResetVisited,
+	"cookies": ResetCookies,
+	"all":     ResetAll,
+}
+
+// ResetStore 支持重置的存储器
+type ResetStore interface {
+	// Reset 清除当前任务的队列、访问记录或cookie
+	Reset(opt ResetOption) error
+}
+
+// ParseResetOption 解析重置内容,多个内容使用逗号分隔,如: queue,visited
+func ParseResetOption(s string) (ResetOption, error) {
+	var opt ResetOption
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		o, ok := resetOptions[name]
+		if !ok {
+			return 0, errors.New(fmt.Sprintf("不支持的重置内容【%s】", name))
+		}
+		opt |= o
+	}
+	if opt == 0 {
+		return 0, errors.New("请指定重置内容")
+	}
+	return opt, nil
+}
+
+// sharedReset Tongs内任务共用的重置内容
+func sharedReset() ResetOption {
+	if Config.Bloom.Alone {
+		return ResetCookies
+	}
+	return ResetVisited | ResetCookies
+}
+
+// Has 是否包含指定的重置内容
+func (o ResetOption) Has(opt ResetOption) bool {
+	return o&opt != 0
+}
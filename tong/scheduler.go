@@ -0,0 +1,427 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	OverlapSkip    = "skip"    //上一次还在运行时跳过本次
+	OverlapQueue   = "queue"   //上一次结束后立即执行,多次触发只执行一次
+	OverlapReplace = "replace" //停止上一次后重新执行
+
+	scheduleTick   = time.Second //检查定时任务的间隔
+	replaceTimeout = time.Minute //replace策略等待上一次停止的最长时间
+)
+
+// Schedule 定时执行Tongs或任务,任务为空时执行Tongs内所有任务
+type Schedule struct {
+	tongs    *Tongs
+	task     *Task
+	cron     *CronSchedule
+	overlap  string
+	enabled  bool
+	next     time.Time
+	last     time.Time
+	pending  bool //queue策略下等待上一次结束
+	replaced bool //replace策略下正在等待上一次停止
+	mu       sync.Mutex
+}
+
+// ScheduleInfo 定时执行的状态
+type ScheduleInfo struct {
+	Tongs   string     `json:"tongs"`
+	Task    string     `json:"task,omitempty"`
+	Cron    string     `json:"cron"`
+	Overlap string     `json:"overlap"`
+	Enabled bool       `json:"enabled"`
+	NextRun *time.Time `json:"nextRun,omitempty"`
+	LastRun *time.Time `json:"lastRun,omitempty"`
+	Pending bool       `json:"pending,omitempty"`
+}
+
+// scheduler 所有定时执行的Tongs和任务,每秒检查一次到期的定时
+type scheduler struct {
+	mu      sync.Mutex
+	entries map[string]*Schedule
+	stop    chan struct{}
+}
+
+var schedules = &scheduler{entries: make(map[string]*Schedule)}
+
+// SetSchedule 定时执行任务,overlap为上一次还在运行时的处理方式,为空时跳过
+// 配置文件中的schedules优先,需要在 Manager.Init 之前调用
+func (t *Task) SetSchedule(cron string, overlap string) *Task {
+	t.cron = cron
+	t.overlap = overlap
+	return t
+}
+
+// SetSchedule 定时执行Tongs内所有任务,配置文件中的schedules优先,需要在 Manager.Init 之前调用
+func (t *Tongs) SetSchedule(cron string, overlap string) *Tongs {
+	t.cron = cron
+	t.overlap = overlap
+	return t
+}
+
+// initSchedules 按 配置文件 > 代码设置 加载定时并启动调度
+func initSchedules() {
+	for _, t := range managers {
+		if t.cron != "" {
+			if err := schedules.set(t, nil, t.cron, t.overlap, true); err != nil {
+				panic(fmt.Sprintf("【%s】定时配置错误,error:%s", t.Name, err.Error()))
+			}
+		}
+		for _, task := range t.Tasks {
+			if task.cron != "" {
+				if err := schedules.set(t, task, task.cron, task.overlap, true); err != nil {
+					panic(fmt.Sprintf("任务【%s】ID:【%s】定时配置错误,error:%s", t.Name+":"+task.Name, task.ID, err.Error()))
+				}
+			}
+		}
+	}
+	for _, c := range Config.Schedules {
+		t, task, err := findScheduleTarget(c.Tongs, c.Task)
+		if err != nil {
+			Log.Warn(fmt.Sprintf("定时配置【%s-%s】跳过: %s", c.Tongs, c.Task, err.Error()))
+			continue
+		}
+		if err := schedules.set(t, task, c.Cron, c.Overlap, !c.Disabled); err != nil {
+			panic(fmt.Sprintf("定时配置【%s-%s】错误,error:%s", c.Tongs, c.Task, err.Error()))
+		}
+	}
+	schedules.start()
+}
+
+// SetSchedule 添加或修改定时,taskName为空时定时执行整个Tongs
+func (m *Manager) SetSchedule(tongsName, taskName, cron, overlap string) error {
+	t, task, err := findScheduleTarget(tongsName, taskName)
+	if err != nil {
+		return err
+	}
+	if err := schedules.set(t, task, cron, overlap, true); err != nil {
+		return err
+	}
+	schedules.start()
+	return nil
+}
+
+// EnableSchedule 开启或暂停定时
+func (m *Manager) EnableSchedule(tongsName, taskName string, enabled bool) error {
+	s, err := schedules.find(tongsName, taskName)
+	if err != nil {
+		return err
+	}
+	s.enable(enabled)
+	Log.Info(fmt.Sprintf("定时【%s】已%s", s.name(), map[bool]string{true: "开启", false: "暂停"}[enabled]))
+	return nil
+}
+
+// RemoveSchedule 删除定时
+func (m *Manager) RemoveSchedule(tongsName, taskName string) error {
+	s, err := schedules.find(tongsName, taskName)
+	if err != nil {
+		return err
+	}
+	schedules.remove(s)
+	Log.Info(fmt.Sprintf("定时【%s】已删除", s.name()))
+	return nil
+}
+
+// Schedules 获取定时,tongsName为空时获取全部
+func (m *Manager) Schedules(tongsName string) []*ScheduleInfo {
+	schedules.mu.Lock()
+	defer schedules.mu.Unlock()
+	infos := make([]*ScheduleInfo, 0, len(schedules.entries))
+	for _, s := range schedules.entries {
+		if tongsName == "" || s.tongs.Name == tongsName {
+			infos = append(infos, s.Info())
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].Tongs != infos[j].Tongs {
+			return infos[i].Tongs < infos[j].Tongs
+		}
+		return infos[i].Task < infos[j].Task
+	})
+	return infos
+}
+
+func findScheduleTarget(tongsName, taskName string) (*Tongs, *Task, error) {
+	t, err := findTongs(tongsName)
+	if err != nil {
+		return nil, nil, err
+	}
+	if taskName == "" {
+		return t, nil, nil
+	}
+	task, err := t.findTaskWithName(taskName)
+	if err != nil {
+		return nil, nil, err
+	}
+	return t, task, nil
+}
+
+func scheduleKey(tongsName, taskName string) string {
+	return tongsName + ":" + taskName
+}
+
+func (c *scheduler) set(t *Tongs, task *Task, expr, overlap string, enabled bool) error {
+	cron, err := ParseCron(expr)
+	if err != nil {
+		return err
+	}
+	if overlap == "" {
+		overlap = OverlapSkip
+	}
+	if overlap != OverlapSkip && overlap != OverlapQueue && overlap != OverlapReplace {
+		return errors.New(fmt.Sprintf("不支持的定时重叠策略【%s】", overlap))
+	}
+	taskName := ""
+	if task != nil {
+		taskName = task.Name
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.entries[scheduleKey(t.Name, taskName)]
+	if !ok {
+		s = &Schedule{tongs: t, task: task}
+		c.entries[scheduleKey(t.Name, taskName)] = s
+	}
+	s.mu.Lock()
+	s.cron = cron
+	s.overlap = overlap
+	s.mu.Unlock()
+	s.enable(enabled)
+	c.link(t)
+	Log.Info(fmt.Sprintf("定时【%s】设置为【%s】,重叠策略【%s】", s.name(), expr, overlap))
+	return nil
+}
+
+func (c *scheduler) find(tongsName, taskName string) (*Schedule, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s, ok := c.entries[scheduleKey(tongsName, taskName)]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("定时【%s】不存在", scheduleKey(tongsName, taskName)))
+	}
+	return s, nil
+}
+
+func (c *scheduler) remove(s *Schedule) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	taskName := ""
+	if s.task != nil {
+		taskName = s.task.Name
+	}
+	delete(c.entries, scheduleKey(s.tongs.Name, taskName))
+	s.enable(false)
+	c.link(s.tongs)
+}
+
+// link 任务详情中显示生效的定时,任务没有单独设置时显示Tongs的定时,调用方持有锁
+func (c *scheduler) link(t *Tongs) {
+	shared := c.entries[scheduleKey(t.Name, "")]
+	for _, task := range t.Tasks {
+		if s, ok := c.entries[scheduleKey(t.Name, task.Name)]; ok {
+			task.Schedule = s
+		} else {
+			task.Schedule = shared
+		}
+	}
+}
+
+// start 启动调度,已启动时忽略
+func (c *scheduler) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil || len(c.entries) == 0 || shuttingDown.Load() {
+		return
+	}
+	c.stop = make(chan struct{})
+	go c.loop(c.stop)
+}
+
+func (c *scheduler) loop(stop chan struct{}) {
+	ticker := time.NewTicker(scheduleTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			entries := make([]*Schedule, 0, len(c.entries))
+			for _, s := range c.entries {
+				entries = append(entries, s)
+			}
+			c.mu.Unlock()
+			for _, s := range entries {
+				s.tick(now)
+			}
+		}
+	}
+}
+
+func (s *Schedule) enable(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.enabled = enabled
+	s.pending = false
+	s.next = time.Time{}
+	if enabled {
+		s.next = s.cron.Next(time.Now())
+	}
+}
+
+// tick 到期时按重叠策略执行,queue策略下上一次结束后执行等待中的一次
+func (s *Schedule) tick(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.enabled {
+		return
+	}
+	if s.pending && !s.running() {
+		s.pending = false
+		go s.run()
+	}
+	if s.next.IsZero() || now.Before(s.next) {
+		return
+	}
+	s.last = now
+	s.next = s.cron.Next(now)
+	if !IsLeader() {
+		//多进程协作时只由主进程定时执行,再通过命令通知其他进程
+		return
+	}
+	if !s.running() {
+		go s.run()
+		return
+	}
+	switch s.overlap {
+	case OverlapQueue:
+		s.pending = true
+		Log.Info(fmt.Sprintf("定时【%s】上一次还在运行,结束后再执行", s.name()))
+	case OverlapReplace:
+		if !s.replaced {
+			s.replaced = true
+			go s.replace()
+		}
+	default:
+		Log.Info(fmt.Sprintf("定时【%s】上一次还在运行,跳过本次", s.name()))
+	}
+}
+
+// running 任务或Tongs内任一任务是否在运行,按依赖运行时等待下游任务的期间也视为运行中
+func (s *Schedule) running() bool {
+	if s.task != nil {
+		return s.task.active()
+	}
+	if s.tongs.graph.isActive() {
+		return true
+	}
+	for _, task := range s.tongs.Tasks {
+		if task.active() {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Schedule) run() {
+	Log.Info(fmt.Sprintf("定时【%s】开始执行", s.name()))
+	var err error
+	if s.task != nil {
+		err = s.task.run("", TriggerSchedule)
+	} else {
+		err = s.tongs.run(TriggerSchedule, nil)
+	}
+	if err != nil {
+		Log.Error(fmt.Sprintf("定时【%s】启动失败, err:%s", s.name(), err.Error()))
+		return
+	}
+	cmd := &Command{Action: CommandRun, Tongs: s.tongs.Name, At: time.Now()}
+	if s.task != nil {
+		cmd.Task = s.task.Name
+	}
+	broadcast(cmd)
+}
+
+// replace 停止上一次执行,等待停止后重新执行
+func (s *Schedule) replace() {
+	defer func() {
+		s.mu.Lock()
+		s.replaced = false
+		s.mu.Unlock()
+	}()
+	Log.Info(fmt.Sprintf("定时【%s】上一次还在运行,停止后重新执行", s.name()))
+	if s.task != nil {
+		s.task.StopWithReason("被新的定时执行替换")
+	} else {
+		for _, task := range s.tongs.Tasks {
+			if task.active() {
+				task.StopWithReason("被新的定时执行替换")
+			}
+		}
+	}
+	deadline := time.Now().Add(replaceTimeout)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		running := s.running()
+		s.mu.Unlock()
+		if !running {
+			s.run()
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	Log.Error(fmt.Sprintf("定时【%s】等待上一次停止超时,本次不执行", s.name()))
+}
+
+func (s *Schedule) name() string {
+	if s.task != nil {
+		return s.tongs.Name + "-" + s.task.Name
+	}
+	return s.tongs.Name
+}
+
+// Info 获取定时状态
+func (s *Schedule) Info() *ScheduleInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info := &ScheduleInfo{
+		Tongs:   s.tongs.Name,
+		Cron:    s.cron.Expr,
+		Overlap: s.overlap,
+		Enabled: s.enabled,
+		Pending: s.pending,
+	}
+	if s.task != nil {
+		info.Task = s.task.Name
+	}
+	if !s.next.IsZero() {
+		next := s.next
+		info.NextRun = &next
+	}
+	if !s.last.IsZero() {
+		last := s.last
+		info.LastRun = &last
+	}
+	return info
+}
+
+// NextRun 下一次执行时间,未开启时返回零值
+func (s *Schedule) NextRun() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next
+}
+
+func (s *Schedule) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Info())
+}
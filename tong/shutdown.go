@@ -0,0 +1,99 @@
+package tong
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	shuttingDown atomic.Bool    //关闭中不再启动任务
+	runs         sync.WaitGroup //运行中的任务,运行记录保存后结束
+)
+
+// Shutdown 停止接收新任务并停止所有运行中的任务,等待执行中的请求和保存完成后返回
+// ctx到期时运行记录按停止保存,仍在执行的队列请求放回队列
+func (m *Manager) Shutdown(ctx context.Context) error {
+	if !shuttingDown.CompareAndSwap(false, true) {
+		return errors.New("正在关闭")
+	}
+	Log.Info("开始关闭,停止所有任务")
+	//任务停止后再注销,停止期间其他进程仍能看到当前进程
+	if w := currentWorker; w != nil {
+		defer w.close()
+	}
+	schedules.close()
+	for _, t := range managers {
+		for _, task := range t.Tasks {
+			if task.active() {
+				task.StopWithReason("服务关闭")
+			}
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		runs.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		Log.Info("所有任务已停止")
+		closeStores()
+		return nil
+	case <-ctx.Done():
+	}
+	var names []string
+	for _, t := range managers {
+		for _, task := range t.Tasks {
+			//队列任务停止后状态立即变为停止,按运行记录判断是否还有执行中的请求
+			//任务协程之后结束时运行记录已结束,不会再次保存
+			run := task.finishRun(&TaskEvent{Tongs: t.Name, Task: task.Name, Type: EventStopped, Error: "停止超时", At: time.Now()})
+			if run == nil {
+				continue
+			}
+			names = append(names, t.Name+"-"+task.Name)
+			if task.IsQueue {
+				//执行中的请求立即放回队列,不等待确认超时
+				if n := task.queue.releaseInflight(); n > 0 {
+					Log.Warn(fmt.Sprintf("队列任务【%s-%s】%d个执行中的请求未确认,已放回队列", t.Name, task.Name, n))
+				}
+			}
+			saveRun(run)
+		}
+	}
+	return errors.New(fmt.Sprintf("任务%v未在规定时间内停止", names))
+}
+
+// closeStores 任务全部停止后关闭存储器,停止过期访问记录的定时清除并关闭日志文件
+func closeStores() {
+	for _, t := range managers {
+		for _, task := range t.Tasks {
+			s, ok := task.store.(io.Closer)
+			if !ok {
+				continue
+			}
+			if err := s.Close(); err != nil {
+				Log.Error(fmt.Sprintf("任务【%s-%s】关闭存储器失败:%s", t.Name, task.Name, err.Error()))
+			}
+		}
+	}
+}
+
+// ShuttingDown 是否正在关闭
+func (m *Manager) ShuttingDown() bool {
+	return shuttingDown.Load()
+}
+
+// close 停止调度
+func (c *scheduler) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+}
@@ -0,0 +1,190 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gocolly/colly/v2"
+)
+
+// TaskStatus 任务状态,数值与旧版本的状态码保持一致,JSON中输出数值,新增的启动中和暂停中为6和7
+type TaskStatus int32
+
+const (
+	StatusStopped  TaskStatus = iota //已停止,新建的任务也是该状态
+	StatusStopping                   //停止中,等待执行中的请求完成
+	StatusRunning                    //运行中
+	StatusFailed                     //执行失败
+	StatusFinished                   //执行完成
+	StatusPaused                     //已暂停
+	StatusStarting                   //启动中
+	StatusPausing                    //暂停中,等待执行中的请求完成
+)
+
+// maxTransitions 每个任务保留的状态变化记录数量
+const maxTransitions = 100
+
+var (
+	statusNames = map[TaskStatus]string{
+		StatusStopped:  "stopped",
+		StatusStopping: "stopping",
+		StatusRunning:  "running",
+		StatusFailed:   "failed",
+		StatusFinished: "finished",
+		StatusPaused:   "paused",
+		StatusStarting: "starting",
+		StatusPausing:  "pausing",
+	}
+	// transitions 允许的状态变化
+	transitions = map[TaskStatus][]TaskStatus{
+		StatusStopped:  {StatusStarting},
+		StatusFinished: {StatusStarting},
+		StatusFailed:   {StatusStarting},
+		StatusStarting: {StatusRunning, StatusFailed},
+		StatusRunning:  {StatusPausing, StatusStopping, StatusFinished, StatusFailed},
+		StatusPausing:  {StatusPaused, StatusRunning, StatusStopping, StatusFailed},
+		StatusPaused:   {StatusRunning, StatusStopping, StatusFailed},
+		StatusStopping: {StatusStopped},
+	}
+)
+
+func (s TaskStatus) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", int32(s))
+}
+
+// Active 任务是否在运行,包括启动中、暂停和停止中
+func (s TaskStatus) Active() bool {
+	return s != StatusStopped && s != StatusFinished && s != StatusFailed
+}
+
+// Transition 任务的一次状态变化
+type Transition struct {
+	From   TaskStatus `json:"from"`
+	To     TaskStatus `json:"to"`
+	Reason string     `json:"reason,omitempty"`
+	At     time.Time  `json:"at"`
+}
+
+// taskState 任务状态,所有变化都在锁内按状态机检查
+type taskState struct {
+	mu      sync.Mutex
+	status  TaskStatus
+	history []*Transition
+}
+
+func (s *taskState) get() TaskStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.status
+}
+
+// to 切换到目标状态,当前状态不允许切换时返回错误
+func (s *taskState) to(to TaskStatus, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.toLocked(to, reason)
+}
+
+func (s *taskState) toLocked(to TaskStatus, reason string) error {
+	for _, allowed := range transitions[s.status] {
+		if allowed == to {
+			s.history = append(s.history, &Transition{From: s.status, To: to, Reason: reason, At: time.Now()})
+			if len(s.history) > maxTransitions {
+				s.history = s.history[len(s.history)-maxTransitions:]
+			}
+			s.status = to
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("状态【%s】不能切换为【%s】", s.status, to))
+}
+
+// finish 运行结束,停止中的任务为已停止,否则按是否出错为执行完成或失败,返回是否是被停止
+func (s *taskState) finish(err error) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.status == StatusStopping {
+		return true, s.toLocked(StatusStopped, "")
+	}
+	if err != nil {
+		return false, s.toLocked(StatusFailed, err.Error())
+	}
+	return false, s.toLocked(StatusFinished, "")
+}
+
+func (s *taskState) transitions() []*Transition {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Transition{}, s.history...)
+}
+
+// State 获取任务当前状态
+func (t *Task) State() TaskStatus {
+	return t.state.get()
+}
+
+// Transitions 获取任务最近的状态变化记录
+func (t *Task) Transitions() []*Transition {
+	return t.state.transitions()
+}
+
+// active 任务启动中、运行中、暂停或停止中
+func (t *Task) active() bool {
+	return t.State().Active()
+}
+
+// setStatus 切换任务状态,不允许的状态变化返回包含任务名称的错误
+func (t *Task) setStatus(to TaskStatus, reason string) error {
+	if err := t.state.to(to, reason); err != nil {
+		return errors.New(fmt.Sprintf("任务【%s】%s", t.Name, err.Error()))
+	}
+	return nil
+}
+
+// MarshalJSON 输出任务信息时附带当前状态,status为与旧版本一致的状态码,statusName为状态名称
+func (t *Task) MarshalJSON() ([]byte, error) {
+	type task Task
+	status := t.State()
+	return json.Marshal(&struct {
+		*task
+		Status     TaskStatus `json:"status"`
+		StatusName string     `json:"statusName"`
+	}{(*task)(t), status, status.String()})
+}
+
+// initControl 普通任务的暂停、停止和去重检查,只在初始化时注册一次,需要在其他请求回调之前注册
+// 暂停时新请求在发出前等待,停止中时新请求被中止,重复的请求被中止
+func initControl(t *Task) {
+	if t.IsQueue {
+		t.queue.onPaused = func() {
+			if err := t.setStatus(StatusPaused, ""); err == nil {
+				Log.Info(fmt.Sprintf("队列任务【%s-%s】已暂停", t.tongs.Name, t.Name))
+			}
+		}
+		return
+	}
+	t.gate = &pauseGate{}
+	t.collector.OnRequest(func(r *colly.Request) {
+		t.gate.wait()
+		if t.State() == StatusStopping || t.visited(r) {
+			t.abort(r)
+		}
+	})
+}
+
+// abort 中止请求并标记,之后注册的请求回调通过isAborted跳过该请求,标记由initRunCounters注册的最后一个请求回调清除
+func (t *Task) abort(r *colly.Request) {
+	r.Abort()
+	t.aborted.Store(r.ID, struct{}{})
+}
+
+func (t *Task) isAborted(r *colly.Request) bool {
+	_, ok := t.aborted.Load(r.ID)
+	return ok
+}
@@ -1,18 +1,15 @@
 package tong
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
-	"hash/fnv"
-	"io"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-redis/redis"
-	"github.com/gocolly/colly/v2"
-	whatwgUrl "github.com/nlnwa/whatwg-url/url"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -38,55 +35,215 @@ type Store interface {
 }
 
 type BloomStore struct {
-	Client    *redis.Client
-	Id        string
-	TongsName string
-	Expires   time.Duration
-	mu        sync.RWMutex
-	IsQueue   bool //是否是队列模式
+	Client        redis.UniversalClient
+	Id            string
+	TongsName     string
+	Expires       time.Duration
+	mu            sync.RWMutex
+	IsQueue       bool                 //是否是队列模式
+	Fingerprinter RequestFingerprinter //队列请求去重的指纹 为空则按url去重GET请求
+	filter        bloomFilter
+	legacy        bool //过滤器由旧版本创建,队列请求按url记录
 }
 
+// bloomVersion 过滤器成员的格式,旧版本的过滤器没有版本标记,队列请求按url字符串写入
+const bloomVersion = "fingerprint"
+
 // Init initializes the redis storage
+// 检测redis是否支持RedisBloom模块,不支持时使用bitmap实现的过滤器
 func (s *BloomStore) Init() error {
 	if s.Client == nil {
 		return errors.New(fmt.Sprintf("【%s】未设置存储器", s.Id))
 	}
+	if s.filter == nil {
+		filter, err := newBloomFilter(s.Client)
+		if err != nil {
+			return errors.New(fmt.Sprintf("【%s】检测布隆过滤器失败: %s", s.Id, err.Error()))
+		}
+		s.filter = filter
+	}
+	if s.Expires > 0 {
+		//分区过滤器在首次写入时创建
+		return nil
+	}
+	if err := s.checkVersion(); err != nil {
+		return errors.New(fmt.Sprintf("【%s】检测布隆过滤器版本失败: %s", s.Id, err.Error()))
+	}
+	return s.filter.reserve(s.Client, s.getBloomID())
+}
+
+// checkVersion 旧版本的队列任务按url字符串写入RedisBloom过滤器,现在按请求指纹写入
+// 没有版本标记的已有过滤器在判断队列请求时同时按url判断,避免升级后全部重新抓取,重置访问记录后不再兼容
+func (s *BloomStore) checkVersion() error {
+	if s.filter.kind() != "module" {
+		//bitmap实现没有旧版本数据
+		return nil
+	}
+	n, err := s.Client.Exists(s.getBloomID()).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return s.Client.Set(s.getVersionID(), bloomVersion, 0).Err()
+	}
+	if err := s.Client.Get(s.getVersionID()).Err(); err != redis.Nil {
+		return err
+	}
+	s.legacy = true
+	Log.Warn(fmt.Sprintf("布隆过滤器【%s】由旧版本创建,队列请求同时按url去重,重置访问记录后不再兼容", s.getBloomID()))
 	return nil
 }
 
-// Clear removes all entries from the storage
+// Clear removes all entries of the task from the storage
 func (s *BloomStore) Clear() error {
+	return s.Reset(ResetAll)
+}
+
+// Reset 清除当前任务的队列、访问记录或cookie,访问记录和cookie在Tongs内共用时会一起清除
+func (s *BloomStore) Reset(opt ResetOption) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	r := s.Client.Keys(fmt.Sprintf("%s:cookie", "*"))
-	keys, err := r.Result()
-	if err != nil {
-		return err
+	var keys []string
+	if opt.Has(ResetQueue) {
+		keys = append(keys, redisQueueKeys(s.Id)...)
 	}
-	r2 := s.Client.Keys(s.Id + ":request:*")
-	keys2, err := r2.Result()
-	if err != nil {
+	if opt.Has(ResetVisited) {
+		keys = append(keys, s.getBloomID(), s.getBloomID()+":bitmap")
+		fresh, err := scanKeys(s.Client, s.getBloomID()+":fresh:*")
+		if err != nil {
+			return err
+		}
+		keys = append(keys, fresh...)
+	}
+	if opt.Has(ResetCookies) {
+		identities, err := redisIdentityKeys(s.Client, s.TongsName)
+		if err != nil {
+			return err
+		}
+		keys = append(append(keys, s.getCookieID()), identities...)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	if err := s.Client.Del(keys...).Err(); err != nil {
 		return err
 	}
-	keys = append(keys, keys2...)
-	keys = append(keys, s.getQueueID())
-	return s.Client.Del(keys...).Err()
+	if !opt.Has(ResetVisited) || s.Expires > 0 {
+		return nil
+	}
+	if s.legacy {
+		s.legacy = false
+		if err := s.Client.Set(s.getVersionID(), bloomVersion, 0).Err(); err != nil {
+			return err
+		}
+	}
+	//重新按配置的容量和错误率创建过滤器,否则首次写入时按RedisBloom的默认值创建
+	return s.filter.reserve(s.Client, s.getBloomID())
 }
 
 // Visited 非队列调用时通过该方法判断去重
 func (s *BloomStore) Visited(requestID uint64) error {
-	return s.Client.Do("BF.ADD", s.getBloomID(), requestID).Err()
+	_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		s.visit(pipe, requestID)
+		return nil
+	})
+	return err
 }
 
 // IsVisited 非队列调用时通过该方法判断去重
+// 设置了有效期时依次检查有效期内的分区过滤器
 func (s *BloomStore) IsVisited(requestID uint64) (bool, error) {
-	_, err := s.Client.Do("BF.EXISTS", s.getBloomID(), requestID).Bool()
-	if err == redis.Nil {
-		return false, nil
-	} else if err != nil {
+	keys := []string{s.getBloomID()}
+	if s.Expires > 0 {
+		keys = s.freshKeys(time.Now())
+	}
+	var results []func() bool
+	_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		for _, key := range keys {
+			results = append(results, s.filter.exists(pipe, key, requestID))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return false, err
+	}
+	for _, exists := range results {
+		if exists() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Visit 记录访问,返回之前是否已访问过,由写入过滤器的结果判断,并发记录同一个请求时只有一个返回未访问
+// 设置了有效期时先检查之前的分区,已访问过的请求不写入当前分区,访问记录不会因重复判断而延长有效期
+func (s *BloomStore) Visit(requestID uint64) (bool, error) {
+	key := s.getBloomID()
+	if s.Expires > 0 {
+		keys := s.freshKeys(time.Now())
+		key = keys[0]
+		var results []func() bool
+		_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, key := range keys[1:] {
+				results = append(results, s.filter.exists(pipe, key, requestID))
+			}
+			return nil
+		})
+		if err != nil && err != redis.Nil {
+			return false, err
+		}
+		for _, exists := range results {
+			if exists() {
+				return true, nil
+			}
+		}
+	}
+	//bitmap实现写入多个位,在事务中写入,否则并发写入时可能都有原来为0的位
+	var added func() bool
+	_, err := s.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		added = s.filter.add(pipe, key, requestID)
+		if s.Expires > 0 {
+			s.filter.expire(pipe, key, s.Expires+s.freshSpan())
+		}
+		return nil
+	})
+	if err != nil {
 		return false, err
 	}
-	return true, nil
+	return !added(), nil
+}
+
+// visit 添加访问记录,设置了有效期时写入当前时间所在的分区过滤器,分区过滤器在有效期后由redis自动删除
+func (s *BloomStore) visit(c redis.Pipeliner, requestID uint64) {
+	if s.Expires <= 0 {
+		s.filter.add(c, s.getBloomID(), requestID)
+		return
+	}
+	key := s.freshKeys(time.Now())[0]
+	s.filter.add(c, key, requestID)
+	s.filter.expire(c, key, s.Expires+s.freshSpan())
+}
+
+// freshSpan 单个分区过滤器覆盖的时间跨度
+func (s *BloomStore) freshSpan() time.Duration {
+	span := (s.Expires / bloomPartitions).Truncate(time.Second)
+	if span < time.Second {
+		span = time.Second
+	}
+	return span
+}
+
+// freshKeys 有效期内的分区过滤器,第一个为当前时间所在的分区
+// 最早一个分区部分超出有效期,不参与判断,访问记录实际在 有效期-分区跨度 到 有效期 之间过期
+func (s *BloomStore) freshKeys(now time.Time) []string {
+	span := int64(s.freshSpan() / time.Second)
+	current := now.Unix() / span
+	oldest := now.Add(-s.Expires).Unix()/span + 1
+	var keys []string
+	for bucket := current; bucket >= oldest || bucket == current; bucket-- {
+		keys = append(keys, fmt.Sprintf("%s:fresh:%d:%d", s.getBloomID(), span, bucket))
+	}
+	return keys
 }
 
 // SetCookies implements colly/storage..SetCookies()
@@ -119,23 +276,68 @@ func (s *BloomStore) Cookies(u *url.URL) string {
 	return cookiesStr
 }
 
+// identityBackend 使用同一个redis的存储器共用账号
+func (s *BloomStore) identityBackend() interface{} {
+	return s.Client
+}
+
+// Identities 获取Tongs内所有账号
+func (s *BloomStore) Identities() ([]*Identity, error) {
+	return redisIdentities(s.Client, s.TongsName)
+}
+
+// SaveIdentity 添加或更新账号状态
+func (s *BloomStore) SaveIdentity(i *Identity) error {
+	return redisSaveIdentity(s.Client, s.TongsName, i)
+}
+
+// RemoveIdentity 删除账号及其cookie
+func (s *BloomStore) RemoveIdentity(name string) error {
+	return redisRemoveIdentity(s.Client, s.TongsName, name)
+}
+
+// IdentityCookies 获取账号在指定host下的cookie
+func (s *BloomStore) IdentityCookies(name string, u *url.URL) string {
+	return redisIdentityCookies(s.Client, s.TongsName, name, u)
+}
+
+// SetIdentityCookies 保存账号在指定host下的cookie
+func (s *BloomStore) SetIdentityCookies(name string, u *url.URL, cookies string) {
+	redisSetIdentityCookies(s.Client, s.TongsName, name, u, cookies)
+}
+
 // AddRequest implements queue.Storage.AddRequest() function
 func (s *BloomStore) AddRequest(r []byte) error {
-	var req colly.Request
-	json.Unmarshal(r, &req)
-	url := req.URL.String()
-	if req.Method == "GET" {
-		exists, err := s.Client.Do("BF.EXISTS", s.getBloomID(), url).Bool()
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	reqId, dedupe := fingerprint(s.Fingerprinter, req)
+	if dedupe {
+		visited, err := s.IsVisited(reqId)
 		if err != nil {
 			return err
 		}
-		if exists {
+		if visited {
 			return nil
 		}
+		if s.legacy && req.Method == "GET" {
+			visited, err := redisDo(s.Client, "BF.EXISTS", s.getBloomID(), req.URL).Bool()
+			if err != nil {
+				return err
+			}
+			if visited {
+				return nil
+			}
+		}
 	}
-	_, err := s.Client.TxPipelined(func(pipe redis.Pipeliner) error {
-		pipe.RPush(s.getQueueID(), r)
-		s.Client.Do("BF.ADD", s.getBloomID(), url)
+	_, err = s.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if err := redisPush(pipe, s.Id, r); err != nil {
+			return err
+		}
+		if dedupe {
+			s.visit(pipe, reqId)
+		}
 		return nil
 	})
 	return err
@@ -143,50 +345,196 @@ func (s *BloomStore) AddRequest(r []byte) error {
 
 // GetRequest implements queue.Storage.GetRequest() function
 func (s *BloomStore) GetRequest() ([]byte, error) {
-	r, err := s.Client.BLPop(10*time.Minute, s.getQueueID()).Result()
+	return redisPop(s.Client, s.Id)
+}
+
+// Ack 请求处理完成后从处理中集合移除
+func (s *BloomStore) Ack(r []byte) error {
+	return redisAck(s.Client, s.Id, r)
+}
+
+// Reclaim 将确认超时的请求放回队列
+func (s *BloomStore) Reclaim() (int, error) {
+	return redisReclaim(s.Client, s.Id)
+}
+
+// Release 将处理中的请求立即放回队列
+func (s *BloomStore) Release(r []byte) error {
+	return redisRelease(s.Client, s.Id, r)
+}
+
+// AddDelayedRequest 添加到期后才进入队列的请求
+func (s *BloomStore) AddDelayedRequest(r []byte, at time.Time) error {
+	return redisPushDelayed(s.Client, s.Id, r, at)
+}
+
+// DelayedSize 等待到期的延迟请求数量
+func (s *BloomStore) DelayedSize() (int, error) {
+	return redisDelayedSize(s.Client, s.Id)
+}
+
+// InflightSize 所有进程已出队但未确认的请求数量
+func (s *BloomStore) InflightSize() (int, error) {
+	return redisInflightSize(s.Client, s.Id)
+}
+
+// PeekRequests 按出队顺序获取请求,不出队
+func (s *BloomStore) PeekRequests(offset, n int) ([][]byte, error) {
+	return redisPeek(s.Client, s.Id, offset, n)
+}
+
+// RemoveRequest 从队列中删除请求
+func (s *BloomStore) RemoveRequest(r []byte) (bool, error) {
+	return redisRemove(s.Client, s.Id, r)
+}
+
+// PushRequest 不去重直接入队
+func (s *BloomStore) PushRequest(r []byte) error {
+	return redisPush(s.Client, s.Id, r)
+}
+
+// AddDeadLetter 添加死信
+func (s *BloomStore) AddDeadLetter(d *DeadLetter) error {
+	return redisAddDeadLetter(s.Client, s.Id, d)
+}
+
+// DeadLetters 按失败时间倒序获取死信
+func (s *BloomStore) DeadLetters(offset, n int) ([]*DeadLetter, error) {
+	return redisDeadLetters(s.Client, s.Id, offset, n)
+}
+
+// DeadLetterSize 死信数量
+func (s *BloomStore) DeadLetterSize() (int, error) {
+	return redisDeadLetterSize(s.Client, s.Id)
+}
+
+// RemoveDeadLetter 删除死信
+func (s *BloomStore) RemoveDeadLetter(id string) (*DeadLetter, error) {
+	return redisRemoveDeadLetter(s.Client, s.Id, id)
+}
+
+// PurgeDeadLetters 清空死信
+func (s *BloomStore) PurgeDeadLetters() (int, error) {
+	return redisPurgeDeadLetters(s.Client, s.Id)
+}
+
+// Export 导出队列、布隆过滤器或cookie,布隆过滤器按分块导出
+func (s *BloomStore) Export(opt ResetOption, fn func(rec *FrontierRecord) error) error {
+	if opt.Has(ResetQueue) {
+		if err := redisExportQueue(s.Client, s.Id, fn); err != nil {
+			return err
+		}
+	}
+	if opt.Has(ResetVisited) {
+		keys, err := s.filterKeys()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			suffix := strings.TrimPrefix(key, s.getBloomID())
+			err := s.filter.dump(s.Client, key, func(iter int64, data []byte) error {
+				return fn(&FrontierRecord{Type: recordBloom, Key: suffix, Field: s.filter.kind(), Iter: iter, Data: data})
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if opt.Has(ResetCookies) {
+		return redisExportCookies(s.Client, s.TongsName, fn)
+	}
+	return nil
+}
+
+// Import 导入一批记录,访问记录写入当前的过滤器,布隆过滤器分块只能导入到相同实现的过滤器
+// 布隆过滤器分块较大,逐个写入,其他记录在一个管道中写入
+func (s *BloomStore) Import(recs []*FrontierRecord) error {
+	batch := make([]*FrontierRecord, 0, len(recs))
+	for _, rec := range recs {
+		if rec.Type != recordBloom {
+			batch = append(batch, rec)
+			continue
+		}
+		if err := s.importChunk(rec); err != nil {
+			return err
+		}
+	}
+	return redisImport(s.Client, s.Id, s.TongsName, batch, func(pipe redis.Pipeliner, rec *FrontierRecord) error {
+		s.visit(pipe, rec.Member)
+		return nil
+	})
+}
+
+func (s *BloomStore) importChunk(rec *FrontierRecord) error {
+	if rec.Field != s.filter.kind() {
+		return errors.New(fmt.Sprintf("布隆过滤器实现不一致,导出为【%s】当前为【%s】", rec.Field, s.filter.kind()))
+	}
+	key := s.getBloomID() + rec.Key
+	if err := s.filter.load(s.Client, key, rec.Iter, rec.Data); err != nil {
+		return err
+	}
+	if rec.Key != "" && s.Expires > 0 {
+		_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+			s.filter.expire(pipe, key, s.Expires+s.freshSpan())
+			return nil
+		})
+		return err
+	}
+	return nil
+}
+
+// filterKeys 当前使用的所有过滤器,包括有效期分区
+func (s *BloomStore) filterKeys() ([]string, error) {
+	keys := []string{s.getBloomID()}
+	fresh, err := scanKeys(s.Client, s.getBloomID()+":fresh:*")
 	if err != nil {
 		return nil, err
 	}
-	if r == nil {
-		return nil, errors.New("queue is empty")
+	seen := make(map[string]bool)
+	for _, key := range fresh {
+		key = strings.TrimSuffix(key, ":bitmap")
+		if !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
 	}
-	return []byte(r[1]), err
+	return keys, nil
 }
 
-// QueueSize implements queue.Storage.QueueSize() function
-func (s *BloomStore) QueueSize() (int, error) {
-	i, err := s.Client.LLen(s.getQueueID()).Result()
-	return int(i), err
+// Keys 获取所在Tongs在redis中的所有key
+func (s *BloomStore) Keys() ([]string, error) {
+	return redisKeys(s.Client, s.TongsName)
 }
 
-func (s *BloomStore) getIDStr(ID uint64) string {
-	return fmt.Sprintf("%s:request:%d", s.Id, ID)
+// QueueSize implements queue.Storage.QueueSize() function
+func (s *BloomStore) QueueSize() (int, error) {
+	return redisQueueSize(s.Client, s.Id)
 }
 
 func (s *BloomStore) getCookieID() string {
 	return fmt.Sprintf("%s:cookie", s.TongsName)
 }
 
-func (s *BloomStore) getQueueID() string {
-	return fmt.Sprintf("%s:queue", s.Id)
+// getVersionID 过滤器版本标记
+func (s *BloomStore) getVersionID() string {
+	return s.getBloomID() + ":version"
 }
+
 func (s *BloomStore) getBloomID() string {
-	if !Config.Bloom.Open || Config.Bloom.Alone {
-		return s.Id
-	}
-	if !Config.Bloom.Alone {
+	if Config.Bloom.Open && !Config.Bloom.Alone {
 		return s.TongsName
 	}
 	return s.Id
 }
 
 type TongsStore struct {
-	Client    *redis.Client
-	Id        string
-	TongsName string
-	Expires   time.Duration
-	mu        sync.RWMutex
-	IsQueue   bool //是否是队列模式
+	Client        redis.UniversalClient
+	Id            string
+	TongsName     string
+	Expires       time.Duration
+	mu            sync.RWMutex
+	IsQueue       bool                 //是否是队列模式
+	Fingerprinter RequestFingerprinter //队列请求去重的指纹 为空则按url去重GET请求
 }
 
 // Init initializes the redis storage
@@ -197,32 +545,56 @@ func (s *TongsStore) Init() error {
 	return nil
 }
 
-// Clear removes all entries from the storage
+// Clear removes all entries of the task from the storage
 func (s *TongsStore) Clear() error {
+	return s.Reset(ResetAll)
+}
+
+// Reset 清除当前任务的队列、访问记录或cookie,访问记录和cookie在Tongs内共用时会一起清除
+func (s *TongsStore) Reset(opt ResetOption) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	r := s.Client.Keys(fmt.Sprintf("%s:cookie", "*"))
-	keys, err := r.Result()
-	if err != nil {
-		return err
+	var keys []string
+	if opt.Has(ResetQueue) {
+		keys = append(keys, redisQueueKeys(s.Id)...)
 	}
-	r2 := s.Client.Keys(s.Id + ":request:*")
-	keys2, err := r2.Result()
-	if err != nil {
-		return err
+	if opt.Has(ResetVisited) {
+		keys = append(keys, s.getVisitedID(), s.getFreshID())
+	}
+	if opt.Has(ResetCookies) {
+		identities, err := redisIdentityKeys(s.Client, s.TongsName)
+		if err != nil {
+			return err
+		}
+		keys = append(append(keys, s.getCookieID()), identities...)
+	}
+	if len(keys) == 0 {
+		return nil
 	}
-	keys = append(keys, keys2...)
-	keys = append(keys, s.getQueueID())
 	return s.Client.Del(keys...).Err()
 }
 
 // Visited 非队列调用时通过该方法判断去重
 func (s *TongsStore) Visited(requestID uint64) error {
-	return s.Client.SAdd(s.getVisitedID(), requestID).Err()
+	_, err := s.Client.Pipelined(func(pipe redis.Pipeliner) error {
+		s.visit(pipe, requestID)
+		return nil
+	})
+	return err
 }
 
 // IsVisited 非队列调用时通过该方法判断去重
+// 设置了有效期时访问记录保存在以访问时间为分数的有序集合中,超过有效期的记录视为未访问
 func (s *TongsStore) IsVisited(requestID uint64) (bool, error) {
+	if s.Expires > 0 {
+		score, err := s.Client.ZScore(s.getFreshID(), strconv.FormatUint(requestID, 10)).Result()
+		if err == redis.Nil {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		return int64(score) >= time.Now().Add(-s.Expires).UnixMilli(), nil
+	}
 	visited, err := s.Client.SIsMember(s.getVisitedID(), requestID).Result()
 	if err == redis.Nil {
 		return false, nil
@@ -232,6 +604,40 @@ func (s *TongsStore) IsVisited(requestID uint64) (bool, error) {
 	return visited, nil
 }
 
+// Visit 记录访问,返回之前是否已访问过,判断和记录在redis中一次完成,并发记录同一个请求时只有一个返回未访问
+func (s *TongsStore) Visit(requestID uint64) (bool, error) {
+	if s.Expires <= 0 {
+		n, err := s.Client.SAdd(s.getVisitedID(), requestID).Result()
+		return n == 0, err
+	}
+	now := time.Now()
+	visited, err := freshVisitScript.Run(s.Client, []string{s.getFreshID()},
+		strconv.FormatUint(requestID, 10), now.UnixMilli(), now.Add(-s.Expires).UnixMilli()).Int()
+	return visited == 1, err
+}
+
+// freshVisitScript 有效期内访问过时返回1,否则记录访问时间并清理过期的记录
+var freshVisitScript = redis.NewScript(`
+local score = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if score and tonumber(score) >= tonumber(ARGV[3]) then
+	return 1
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[3])
+return 0`)
+
+// visit 添加访问记录,设置了有效期时同时清理已过期的记录
+// Tongs内共用访问记录时,各任务的有效期必须一致,在初始化时检查
+func (s *TongsStore) visit(c redis.Cmdable, requestID uint64) {
+	if s.Expires <= 0 {
+		c.SAdd(s.getVisitedID(), requestID)
+		return
+	}
+	now := time.Now()
+	c.ZAdd(s.getFreshID(), redis.Z{Score: float64(now.UnixMilli()), Member: strconv.FormatUint(requestID, 10)})
+	c.ZRemRangeByScore(s.getFreshID(), "-inf", fmt.Sprintf("(%d", now.Add(-s.Expires).UnixMilli()))
+}
+
 // SetCookies implements colly/storage..SetCookies()
 func (s *TongsStore) SetCookies(u *url.URL, cookies string) {
 	s.mu.Lock()
@@ -262,13 +668,44 @@ func (s *TongsStore) Cookies(u *url.URL) string {
 	return cookiesStr
 }
 
+// identityBackend 使用同一个redis的存储器共用账号
+func (s *TongsStore) identityBackend() interface{} {
+	return s.Client
+}
+
+// Identities 获取Tongs内所有账号
+func (s *TongsStore) Identities() ([]*Identity, error) {
+	return redisIdentities(s.Client, s.TongsName)
+}
+
+// SaveIdentity 添加或更新账号状态
+func (s *TongsStore) SaveIdentity(i *Identity) error {
+	return redisSaveIdentity(s.Client, s.TongsName, i)
+}
+
+// RemoveIdentity 删除账号及其cookie
+func (s *TongsStore) RemoveIdentity(name string) error {
+	return redisRemoveIdentity(s.Client, s.TongsName, name)
+}
+
+// IdentityCookies 获取账号在指定host下的cookie
+func (s *TongsStore) IdentityCookies(name string, u *url.URL) string {
+	return redisIdentityCookies(s.Client, s.TongsName, name, u)
+}
+
+// SetIdentityCookies 保存账号在指定host下的cookie
+func (s *TongsStore) SetIdentityCookies(name string, u *url.URL, cookies string) {
+	redisSetIdentityCookies(s.Client, s.TongsName, name, u, cookies)
+}
+
 // AddRequest implements queue.Storage.AddRequest() function
 func (s *TongsStore) AddRequest(r []byte) error {
-	var req map[string]interface{}
-	json.Unmarshal(r, &req)
-	var reqId uint64
-	if req["Method"] == "GET" {
-		reqId = requestHash(req["URL"].(string), nil)
+	req, err := parseRequest(r)
+	if err != nil {
+		return err
+	}
+	reqId, dedupe := fingerprint(s.Fingerprinter, req)
+	if dedupe {
 		visited, err := s.IsVisited(reqId)
 		if err != nil {
 			return err
@@ -278,10 +715,12 @@ func (s *TongsStore) AddRequest(r []byte) error {
 		}
 	}
 
-	_, err := s.Client.TxPipelined(func(pipe redis.Pipeliner) error {
-		pipe.RPush(s.getQueueID(), r)
-		if reqId != 0 {
-			pipe.SAdd(s.getVisitedID(), reqId)
+	_, err = s.Client.TxPipelined(func(pipe redis.Pipeliner) error {
+		if err := redisPush(pipe, s.Id, r); err != nil {
+			return err
+		}
+		if dedupe {
+			s.visit(pipe, reqId)
 		}
 		return nil
 	})
@@ -290,34 +729,150 @@ func (s *TongsStore) AddRequest(r []byte) error {
 
 // GetRequest implements queue.Storage.GetRequest() function
 func (s *TongsStore) GetRequest() ([]byte, error) {
-	r, err := s.Client.BLPop(10*time.Minute, s.getQueueID()).Result()
-	if err != nil {
-		return nil, err
+	return redisPop(s.Client, s.Id)
+}
+
+// Ack 请求处理完成后从处理中集合移除
+func (s *TongsStore) Ack(r []byte) error {
+	return redisAck(s.Client, s.Id, r)
+}
+
+// Reclaim 将确认超时的请求放回队列
+func (s *TongsStore) Reclaim() (int, error) {
+	return redisReclaim(s.Client, s.Id)
+}
+
+// Release 将处理中的请求立即放回队列
+func (s *TongsStore) Release(r []byte) error {
+	return redisRelease(s.Client, s.Id, r)
+}
+
+// AddDelayedRequest 添加到期后才进入队列的请求
+func (s *TongsStore) AddDelayedRequest(r []byte, at time.Time) error {
+	return redisPushDelayed(s.Client, s.Id, r, at)
+}
+
+// DelayedSize 等待到期的延迟请求数量
+func (s *TongsStore) DelayedSize() (int, error) {
+	return redisDelayedSize(s.Client, s.Id)
+}
+
+// InflightSize 所有进程已出队但未确认的请求数量
+func (s *TongsStore) InflightSize() (int, error) {
+	return redisInflightSize(s.Client, s.Id)
+}
+
+// PeekRequests 按出队顺序获取请求,不出队
+func (s *TongsStore) PeekRequests(offset, n int) ([][]byte, error) {
+	return redisPeek(s.Client, s.Id, offset, n)
+}
+
+// RemoveRequest 从队列中删除请求
+func (s *TongsStore) RemoveRequest(r []byte) (bool, error) {
+	return redisRemove(s.Client, s.Id, r)
+}
+
+// PushRequest 不去重直接入队
+func (s *TongsStore) PushRequest(r []byte) error {
+	return redisPush(s.Client, s.Id, r)
+}
+
+// AddDeadLetter 添加死信
+func (s *TongsStore) AddDeadLetter(d *DeadLetter) error {
+	return redisAddDeadLetter(s.Client, s.Id, d)
+}
+
+// DeadLetters 按失败时间倒序获取死信
+func (s *TongsStore) DeadLetters(offset, n int) ([]*DeadLetter, error) {
+	return redisDeadLetters(s.Client, s.Id, offset, n)
+}
+
+// DeadLetterSize 死信数量
+func (s *TongsStore) DeadLetterSize() (int, error) {
+	return redisDeadLetterSize(s.Client, s.Id)
+}
+
+// RemoveDeadLetter 删除死信
+func (s *TongsStore) RemoveDeadLetter(id string) (*DeadLetter, error) {
+	return redisRemoveDeadLetter(s.Client, s.Id, id)
+}
+
+// PurgeDeadLetters 清空死信
+func (s *TongsStore) PurgeDeadLetters() (int, error) {
+	return redisPurgeDeadLetters(s.Client, s.Id)
+}
+
+// Export 导出队列、访问记录或cookie
+func (s *TongsStore) Export(opt ResetOption, fn func(rec *FrontierRecord) error) error {
+	if opt.Has(ResetQueue) {
+		if err := redisExportQueue(s.Client, s.Id, fn); err != nil {
+			return err
+		}
+	}
+	if opt.Has(ResetVisited) {
+		err := scanMembers(s.Client.SScan, s.getVisitedID(), func(member string) error {
+			id, err := strconv.ParseUint(member, 10, 64)
+			if err != nil {
+				return nil
+			}
+			return fn(&FrontierRecord{Type: recordVisited, Member: id})
+		})
+		if err != nil {
+			return err
+		}
+		fresh, err := s.Client.ZRangeWithScores(s.getFreshID(), 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, z := range fresh {
+			id, err := strconv.ParseUint(z.Member.(string), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := fn(&FrontierRecord{Type: recordVisited, Member: id, Time: int64(z.Score)}); err != nil {
+				return err
+			}
+		}
 	}
-	if r == nil {
-		return nil, errors.New("queue is empty")
+	if opt.Has(ResetCookies) {
+		return redisExportCookies(s.Client, s.TongsName, fn)
 	}
-	return []byte(r[1]), err
+	return nil
 }
 
-// QueueSize implements queue.Storage.QueueSize() function
-func (s *TongsStore) QueueSize() (int, error) {
-	i, err := s.Client.LLen(s.getQueueID()).Result()
+// Import 导入一批记录,设置了有效期时访问记录保留原来的访问时间
+func (s *TongsStore) Import(recs []*FrontierRecord) error {
+	return redisImport(s.Client, s.Id, s.TongsName, recs, func(pipe redis.Pipeliner, rec *FrontierRecord) error {
+		if rec.Type == recordBloom {
+			return errors.New("布隆过滤器只能导入到bloom存储器")
+		}
+		if s.Expires <= 0 {
+			pipe.SAdd(s.getVisitedID(), rec.Member)
+			return nil
+		}
+		at := rec.Time
+		if at == 0 {
+			at = time.Now().UnixMilli()
+		}
+		pipe.ZAdd(s.getFreshID(), redis.Z{Score: float64(at), Member: strconv.FormatUint(rec.Member, 10)})
+		return nil
+	})
+}
 
-	return int(i), err
+// Keys 获取所在Tongs在redis中的所有key
+func (s *TongsStore) Keys() ([]string, error) {
+	return redisKeys(s.Client, s.TongsName)
 }
 
-func (s *TongsStore) getIDStr(ID uint64) string {
-	return fmt.Sprintf("%s:request:%d", s.Id, ID)
+// QueueSize implements queue.Storage.QueueSize() function
+func (s *TongsStore) QueueSize() (int, error) {
+	return redisQueueSize(s.Client, s.Id)
 }
 
 func (s *TongsStore) getCookieID() string {
 	return fmt.Sprintf("%s:cookie", s.TongsName)
 }
 
-func (s *TongsStore) getQueueID() string {
-	return fmt.Sprintf("%s:queue", s.Id)
-}
 func (s *TongsStore) getVisitedID() string {
 	if Config.Bloom.Alone {
 		return fmt.Sprintf("%s:visited", s.Id)
@@ -326,18 +881,94 @@ func (s *TongsStore) getVisitedID() string {
 	}
 }
 
-func requestHash(url string, body io.Reader) uint64 {
-	h := fnv.New64a()
-	// reparse the url to fix ambiguities such as
-	// "http://example.com" vs "http://example.com/"
-	parsedWhatwgURL, err := whatwgUrl.Parse(url)
-	if err == nil {
-		h.Write([]byte(parsedWhatwgURL.String()))
-	} else {
-		h.Write([]byte(url))
+// getFreshID 设置了有效期时的访问记录
+func (s *TongsStore) getFreshID() string {
+	return s.getVisitedID() + ":fresh"
+}
+
+// bloomPartitions 设置了有效期时布隆过滤器按时间划分的分区数量
+const bloomPartitions = 4
+
+// scanKeys 获取匹配pattern的所有key,集群模式下遍历所有主节点
+func scanKeys(c redis.UniversalClient, pattern string) ([]string, error) {
+	cluster, ok := c.(*redis.ClusterClient)
+	if !ok {
+		return scanNodeKeys(c, pattern)
+	}
+	var keys []string
+	var mu sync.Mutex
+	err := cluster.ForEachMaster(func(node *redis.Client) error {
+		batch, err := scanNodeKeys(node, pattern)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		keys = append(keys, batch...)
+		mu.Unlock()
+		return nil
+	})
+	return keys, err
+}
+
+func scanNodeKeys(c redis.Cmdable, pattern string) ([]string, error) {
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := c.Scan(cursor, pattern, 100).Result()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, batch...)
+		if next == 0 {
+			return keys, nil
+		}
+		cursor = next
+	}
+}
+
+// redisDo 执行客户端没有封装的命令,如RedisBloom模块的命令
+func redisDo(c redis.UniversalClient, args ...interface{}) *redis.Cmd {
+	cmd := redis.NewCmd(args...)
+	c.Process(cmd)
+	return cmd
+}
+
+// redisKeyIDs 任务在redis中的key前缀,设置了命名空间时加在最前面
+// 集群模式下使用Tongs ID作为hash tag,同一Tongs的key分配到同一个slot,保证脚本和事务中的key在同一节点
+func redisKeyIDs(c redis.UniversalClient, t *Task) (id string, tongs string) {
+	tongs = getTongsId(t.tongs.Name)
+	id = t.ID
+	if _, ok := c.(*redis.ClusterClient); ok {
+		tag := "{" + tongs + "}"
+		if strings.HasPrefix(id, tongs+":") {
+			id = tag + strings.TrimPrefix(id, tongs)
+		} else {
+			id = tag + ":" + id
+		}
+		tongs = tag
 	}
-	if body != nil {
-		io.Copy(h, body)
+	if prefix := keyPrefix(t.tongs); prefix != "" {
+		return prefix + ":" + id, prefix + ":" + tongs
+	}
+	return id, tongs
+}
+
+// scanMembers 使用SSCAN遍历集合
+func scanMembers(scan func(key string, cursor uint64, match string, count int64) *redis.ScanCmd, key string, fn func(member string) error) error {
+	var cursor uint64
+	for {
+		members, next, err := scan(key, cursor, "", 1000).Result()
+		if err != nil {
+			return err
+		}
+		for _, m := range members {
+			if err := fn(m); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
 	}
-	return h.Sum64()
 }
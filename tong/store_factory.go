@@ -0,0 +1,127 @@
+package tong
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// StoreFactory 根据任务创建存储器
+type StoreFactory func(t *Task) (Store, error)
+
+var (
+	storeFactories = map[string]StoreFactory{
+		"redis":  newTongsStore,
+		"bloom":  newBloomStore,
+		"memory": newMemoryStore,
+		"file":   newFileStore,
+	}
+	storeFactoriesMu sync.RWMutex
+)
+
+// RegisterStore 注册存储器,name对应配置中的store.type,同名注册会覆盖已有的存储器
+// 需要在 Manager.Init 之前调用
+func RegisterStore(name string, factory StoreFactory) {
+	storeFactoriesMu.Lock()
+	defer storeFactoriesMu.Unlock()
+	storeFactories[name] = factory
+}
+
+// StoreTypes 获取所有已注册的存储器类型
+func StoreTypes() []string {
+	storeFactoriesMu.RLock()
+	defer storeFactoriesMu.RUnlock()
+	var types []string
+	for name := range storeFactories {
+		types = append(types, name)
+	}
+	return types
+}
+
+// newStore 按 任务配置 > 任务代码设置 > 全局配置 的顺序选择存储器
+func newStore(t *Task) (Store, error) {
+	storeType := storeTypeOf(t)
+	storeFactoriesMu.RLock()
+	factory, ok := storeFactories[storeType]
+	storeFactoriesMu.RUnlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("存储器【%s】未注册", storeType))
+	}
+	return factory(t)
+}
+
+func storeTypeOf(t *Task) string {
+	if c := taskConfig(t); c.Store != "" {
+		return c.Store
+	}
+	if t.StoreType != "" {
+		return t.StoreType
+	}
+	if Config.Store.Type != "" {
+		return Config.Store.Type
+	}
+	if Config.Bloom.Open {
+		return "bloom"
+	}
+	return "redis"
+}
+
+// freshness 访问记录有效期,为0时永久有效
+func freshness(t *Task) time.Duration {
+	if t.Freshness <= 0 {
+		return 0
+	}
+	return time.Duration(t.Freshness) * time.Hour
+}
+
+func newTongsStore(t *Task) (Store, error) {
+	id, tongs := redisKeyIDs(Redis, t)
+	return &TongsStore{
+		Id:            id,
+		TongsName:     tongs,
+		Client:        Redis,
+		IsQueue:       t.IsQueue,
+		Fingerprinter: t.fingerprinter,
+		Expires:       freshness(t),
+	}, nil
+}
+
+func newBloomStore(t *Task) (Store, error) {
+	id, tongs := redisKeyIDs(BloomRedis, t)
+	return &BloomStore{
+		Id:            id,
+		TongsName:     tongs,
+		Client:        BloomRedis,
+		IsQueue:       t.IsQueue,
+		Fingerprinter: t.fingerprinter,
+		Expires:       freshness(t),
+	}, nil
+}
+
+func newMemoryStore(t *Task) (Store, error) {
+	return &MemoryStore{
+		Id:            t.ID,
+		TongsName:     getTongsId(t.tongs.Name),
+		IsQueue:       t.IsQueue,
+		Fingerprinter: t.fingerprinter,
+		Expires:       freshness(t),
+	}, nil
+}
+
+func newFileStore(t *Task) (Store, error) {
+	dir := Config.Store.Dir
+	if dir == "" {
+		dir = "data"
+	}
+	return &FileStore{
+		MemoryStore: MemoryStore{
+			Id:            t.ID,
+			TongsName:     getTongsId(t.tongs.Name),
+			IsQueue:       t.IsQueue,
+			Fingerprinter: t.fingerprinter,
+			Expires:       freshness(t),
+		},
+		Dir: dir,
+	}, nil
+}
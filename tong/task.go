@@ -9,32 +9,55 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gocolly/colly/v2"
-	"github.com/gocolly/colly/v2/queue"
 	whatwgUrl "github.com/nlnwa/whatwg-url/url"
 )
 
 var urlParser = whatwgUrl.NewParser(whatwgUrl.WithPercentEncodeSinglePercentSign())
 
 type Task struct {
-	tongs     *Tongs           `json:"-"`
-	Name      string           `json:"name,omitempty"` //任务名称
-	ID        string           `json:"ID,omitempty"`
-	StartUrl  string           `json:"startUrl,omitempty"` //首次启动url，队列模式可为空，非队列必填
-	Status    int              `json:"status,omitempty"`   //当前任务状态
-	AutoUA    bool             `json:"autoUA"`
-	AutoDelay bool             `json:"autoDelay"`
-	Delay     int              `json:"delay"`
-	MaxDepth  int              `json:"maxDepth"`
-	Thread    int              `json:"thread"`
-	UaType    string           `json:"uaType"`
-	IsQueue   bool             `json:"isQueue"`
-	Ctx       *colly.Context   `json:"-"`
-	Domain    string           `json:"domain"`
-	queue     *queue.Queue     `json:"-"` //任务队列
-	collector *colly.Collector `json:"-"` //colly scraper job
-	store     Store            `json:"-"` //存储器
+	tongs            *Tongs               `json:"-"`
+	Name             string               `json:"name,omitempty"` //任务名称
+	ID               string               `json:"ID,omitempty"`
+	StartUrl         string               `json:"startUrl,omitempty"` //首次启动url，队列模式可为空，非队列必填
+	AutoUA           bool                 `json:"autoUA"`
+	AutoDelay        bool                 `json:"autoDelay"`
+	Delay            int                  `json:"delay"`
+	MaxDepth         int                  `json:"maxDepth"`
+	Thread           int                  `json:"thread"`
+	UaType           string               `json:"uaType"`
+	IsQueue          bool                 `json:"isQueue"`
+	Ctx              *colly.Context       `json:"-"`
+	Domain           string               `json:"domain"`
+	StoreType        string               `json:"storeType,omitempty"`        //存储器类型 为空则使用配置
+	Freshness        int                  `json:"freshness,omitempty"`        //访问记录有效期,单位小时 为0时永久有效
+	IdentityRotation string               `json:"identityRotation,omitempty"` //账号轮换策略 为空不启用
+	Schedule         *Schedule            `json:"schedule,omitempty"`         //生效的定时,任务没有单独设置时为Tongs的定时
+	Depends          []*Dependency        `json:"depends,omitempty"`          //依赖的上游任务,通过Tongs启动时上游结束后才启动
+	queue            *Queue               `json:"-"`                          //任务队列
+	collector        *colly.Collector     `json:"-"`                          //colly scraper job
+	store            Store                `json:"-"`                          //存储器
+	fingerprinter    RequestFingerprinter `json:"-"`                          //请求去重的指纹
+	visitCheck       bool                 `json:"-"`                          //普通任务是否按请求指纹去重
+	aborted          sync.Map             `json:"-"`                          //请求回调中被中止的请求ID
+	identities       *identityPool        `json:"-"`                          //账号池
+	retireStatus     []int                `json:"-"`                          //停用账号的响应状态码
+	retry            *retryPolicy         `json:"-"`                          //失败请求重试策略
+	cron             string               `json:"-"`                          //代码设置的定时
+	overlap          string               `json:"-"`                          //代码设置的定时重叠策略
+	listeners        []func(e *TaskEvent) `json:"-"`                          //运行结束事件的回调
+	idleTimeout      time.Duration        `json:"-"`                          //代码设置的队列空闲超时时间
+	stopReason       string               `json:"-"`                          //本次运行的停止原因
+	lastRun          *TaskRun             `json:"-"`                          //最近一次运行记录
+	runMu            sync.Mutex           `json:"-"`                          //保护运行记录和停止原因
+	counters         runCounters          `json:"-"`                          //本次运行的计数
+	gate             *pauseGate           `json:"-"`                          //普通任务的暂停开关
+	retries          retryTimers          `json:"-"`                          //普通任务等待中的重试
+	state            taskState            `json:"-"`                          //任务状态
 }
 
 func (t *Task) Init() {
@@ -44,7 +67,15 @@ func (t *Task) Init() {
 	t.MaxDepth = config.MaxDepth
 	t.collector.MaxDepth = t.MaxDepth
 	t.Ctx = colly.NewContext()
+	if c := taskConfig(t); c.Freshness > 0 {
+		t.Freshness = c.Freshness
+	}
+	initFingerprinter(t)
 	initStore(t)
+	initControl(t)
+	initIdentity(t)
+	initRetry(t)
+	initRunCounters(t)
 	autoUserAgent(t)
 	autoDelay(t)
 }
@@ -62,7 +93,7 @@ func (t *Task) SetStartUrl(startUrl string) *Task {
 	t.StartUrl = startUrl
 	return t
 }
-func (t *Task) SetQueue(q *queue.Queue) *Task {
+func (t *Task) SetQueue(q *Queue) *Task {
 	t.queue = q
 	return t
 }
@@ -78,6 +109,43 @@ func (t *Task) SetThread(thread int) *Task {
 	t.Thread = thread
 	return t
 }
+func (t *Task) SetStoreType(storeType string) *Task {
+	t.StoreType = storeType
+	return t
+}
+
+// SetFreshness 设置访问记录有效期,单位小时,过期后同一请求可以再次抓取,用于定期刷新列表页等场景
+func (t *Task) SetFreshness(hours int) *Task {
+	t.Freshness = hours
+	return t
+}
+
+// SetFingerprinter 设置队列请求去重的指纹,优先于配置文件
+func (t *Task) SetFingerprinter(f RequestFingerprinter) *Task {
+	t.fingerprinter = f
+	return t
+}
+
+// SetIdentityRotation 设置账号轮换策略 RotationRequest 或 RotationSession,响应retireStatus中的状态码时停用当前账号
+func (t *Task) SetIdentityRotation(rotation string, retireStatus ...int) *Task {
+	t.IdentityRotation = rotation
+	t.retireStatus = retireStatus
+	return t
+}
+
+// SetRetry 设置失败请求的重试策略,第n次重试前等待 backoff*2^(n-1),status为空时所有错误都重试
+// 超过重试次数的请求写入死信队列
+func (t *Task) SetRetry(maxRetries int, backoff time.Duration, status ...int) *Task {
+	t.retry = &retryPolicy{maxRetries: maxRetries, backoff: backoff, status: status}
+	return t
+}
+
+// SetIdleTimeout 设置队列空闲超时时间,队列为空且所有进程都没有处理中的请求后,再等待d没有新请求才算执行完成
+// 多个进程运行同一个队列任务或请求由其他任务添加时使用
+func (t *Task) SetIdleTimeout(d time.Duration) *Task {
+	t.idleTimeout = d
+	return t
+}
 func (t *Task) SetCollector(f func(*colly.Collector, *Task)) *Task {
 	f(t.collector, t)
 	return t
@@ -129,6 +197,24 @@ func (t *Task) AddURL(URL string) error {
 	return t.AddRequest(r)
 }
 
+// AddURLWithPriority 给当前任务添加指定优先级的url,数值越大越先执行,绝对值不能超过MaxPriority,仅队列任务有效
+func (t *Task) AddURLWithPriority(URL string, priority int) error {
+	r, err := t.NewRequest(URL, "GET", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return t.AddRequestWithPriority(r, priority)
+}
+
+// AddURLAfter 给当前任务添加在d之后执行的url,仅队列任务有效
+func (t *Task) AddURLAfter(URL string, d time.Duration) error {
+	r, err := t.NewRequest(URL, "GET", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return t.AddRequestAt(r, time.Now().Add(d))
+}
+
 // AddURL 给当前任务添加url
 func (t *Task) AddURLWith(URL string, ctx map[string]interface{}, headers map[string]interface{}) error {
 	r, err := t.NewRequest(URL, "GET", nil, ctx, headers)
@@ -195,6 +281,26 @@ func (t *Task) AddRequest(r *colly.Request) error {
 	}
 }
 
+// AddRequestWithPriority 添加指定优先级的请求,数值越大越先执行,绝对值不能超过MaxPriority,未指定优先级的请求使用请求深度作为优先级
+// 优先级随请求序列化传递给存储器,不会被子请求继承,仅队列任务有效
+func (t *Task) AddRequestWithPriority(r *colly.Request, priority int) error {
+	if !t.IsQueue {
+		return t.AddRequest(r)
+	}
+	Log.Debug(fmt.Sprintf("队列任务【%s-%s】追加请求: %s 优先级: %d", t.tongs.Name, t.Name, r.URL.String(), priority))
+	return t.queue.AddRequestWithPriority(r, priority)
+}
+
+// AddRequestAt 添加在指定时间之后执行的请求,用于定时复查页面或被限流后延后重试
+// 延迟请求不做去重,到期后进入队列按优先级执行,仅队列任务有效
+func (t *Task) AddRequestAt(r *colly.Request, at time.Time) error {
+	if !t.IsQueue {
+		return errors.New(fmt.Sprintf("【%s】普通任务不支持延迟请求", t.Name))
+	}
+	Log.Debug(fmt.Sprintf("队列任务【%s-%s】追加延迟请求: %s 执行时间: %s", t.tongs.Name, t.Name, r.URL.String(), at.Format("2006-01-02 15:04:05")))
+	return t.queue.AddRequestAt(r, at)
+}
+
 // AddCtx 添加上下文内容
 func (t *Task) SetCtx(key string, value interface{}) {
 	t.Ctx.Put(key, value)
@@ -207,66 +313,168 @@ func (t *Task) GetCtx(key string) interface{} {
 
 // Run 启动任务
 func (t *Task) Run(url string) error {
-	if t.Status == Status["running"] {
-		return nil
+	return t.run(url, TriggerManual)
+}
+
+// run 按触发方式启动任务,触发方式记录在运行记录中
+func (t *Task) run(url, trigger string) error {
+	if shuttingDown.Load() {
+		return errors.New(fmt.Sprintf("正在关闭,不能启动任务【%s】", t.Name))
+	}
+	if err := t.setStatus(StatusStarting, trigger); err != nil {
+		return err
+	}
+	if t.identities != nil {
+		t.identities.resetSession()
 	}
 	if t.IsQueue {
-		return t.queueRun(url)
+		return t.queueRun(url, trigger)
 	} else {
-		return t.collectorRun(url)
+		return t.collectorRun(url, trigger)
 	}
 }
 
 // Stop 停止任务
-func (t *Task) Stop() {
-	t.Status = Status["stopping"]
+func (t *Task) Stop() error {
+	return t.StopWithReason("手动停止")
+}
+
+// StopWithReason 停止任务并记录停止原因,执行中的请求完成后变为已停止
+func (t *Task) StopWithReason(reason string) error {
+	if err := t.setStatus(StatusStopping, reason); err != nil {
+		return err
+	}
+	t.runMu.Lock()
+	t.stopReason = reason
+	t.runMu.Unlock()
 	if t.IsQueue {
 		t.queue.Stop()
-		t.Status = Status["stop"]
-		Log.Info(fmt.Sprintf("队列任务【%s-%s】已停止", t.tongs.Name, t.Name))
-		return
-	}
-	t.collector.OnRequest(func(request *colly.Request) {
-		if t.Status == Status["stopping"] {
-			request.Abort()
-			t.Status = Status["stop"]
-			Log.Info(fmt.Sprintf("普通任务【%s-%s】已停止", t.tongs.Name, t.Name))
-		}
-	})
+	} else {
+		//暂停中等待的请求放行后被中止
+		t.retries.cancel()
+		t.gate.open()
+	}
+	Log.Info(fmt.Sprintf("任务【%s-%s】停止中", t.tongs.Name, t.Name))
+	return nil
+}
+
+// end 运行结束,更新状态并发出运行结束事件
+func (t *Task) end(err error) {
+	stopped, serr := t.state.finish(err)
+	if serr != nil {
+		Log.Error(fmt.Sprintf("任务【%s-%s】%s", t.tongs.Name, t.Name, serr.Error()))
+	}
+	switch {
+	case stopped:
+		Log.Info(fmt.Sprintf("任务【%s-%s】已停止", t.tongs.Name, t.Name))
+	case err != nil:
+		Log.Error(fmt.Sprintf("任务【%s-%s】执行失败, err:%s", t.tongs.Name, t.Name, err.Error()))
+	default:
+		Log.Info(fmt.Sprintf("任务【%s-%s】执行完成", t.tongs.Name, t.Name))
+	}
+	t.complete(stopped, err)
+}
+
+// Reset 重置任务的队列、访问记录或cookie,任务运行中不能重置
+// Tongs内有多个任务时,共用的访问记录和cookie会影响其他任务,只能通过Tongs.Reset重置
+func (t *Task) Reset(opt ResetOption) error {
+	if t.active() {
+		return errors.New(fmt.Sprintf("任务【%s】运行中,请先停止任务", t.Name))
+	}
+	if opt.Has(sharedReset()) && len(t.tongs.Tasks) > 1 {
+		return errors.New(fmt.Sprintf("任务【%s】的访问记录或cookie在【%s】内共用,请重置整个Tongs", t.Name, t.tongs.Name))
+	}
+	return t.reset(opt)
+}
+
+func (t *Task) reset(opt ResetOption) error {
+	s, ok := t.store.(ResetStore)
+	if !ok {
+		return errors.New(fmt.Sprintf("任务【%s】的存储器不支持重置", t.Name))
+	}
+	if err := s.Reset(opt); err != nil {
+		return err
+	}
+	if opt.Has(ResetCookies) {
+		//账号和账号的cookie随cookie一起清除,重新加载账号池
+		t.tongs.invalidateIdentities()
+	}
+	Log.Info(fmt.Sprintf("任务【%s-%s】已重置", t.tongs.Name, t.Name))
+	return nil
+}
+
+// RetireIdentity 停用账号,用于在回调中根据页面内容判断账号被封禁等情况
+func (t *Task) RetireIdentity(name, reason string) error {
+	if t.identities == nil {
+		return errors.New(fmt.Sprintf("任务【%s】未启用账号轮换", t.Name))
+	}
+	return t.identities.retire(name, reason)
+}
+
+// RequestIdentity 获取请求使用的账号,未分配账号时返回空
+func (t *Task) RequestIdentity(r *colly.Request) string {
+	if t.identities == nil {
+		return ""
+	}
+	if a, ok := t.identities.assigned.Load(r.ID); ok {
+		return a.(*identityAssignment).name
+	}
+	return ""
 }
 
 // Save 保存item
 func (t *Task) Save(m map[string]interface{}) error {
-	return t.tongs.Save(m)
+	if err := t.tongs.Save(m); err != nil {
+		return err
+	}
+	atomic.AddInt64(&t.counters.items, 1)
+	return nil
 }
 
-func (t *Task) queueRun(url string) error {
+// failStart 启动失败,任务从启动中变为失败
+func (t *Task) failStart(reason string) {
+	if err := t.setStatus(StatusFailed, reason); err != nil {
+		Log.Error(fmt.Sprintf("任务【%s-%s】%s", t.tongs.Name, t.Name, err.Error()))
+	}
+}
+
+func (t *Task) queueRun(url, trigger string) error {
+	if t.collector.Async {
+		//异步collector的请求在Do返回后才执行回调,确认过早会导致进程退出时请求丢失
+		Log.Error(fmt.Sprintf("队列任务【%s-%s】启动失败, err:%s", t.tongs.Name, t.Name, "不支持异步collector"))
+		t.failStart("不支持异步collector")
+		return errors.New(fmt.Sprintf("【%s】队列任务不支持异步collector,请关闭Async", t.Name))
+	}
 	var startUrl string
 	if url != "" {
 		startUrl = url
 	} else {
 		startUrl = t.StartUrl
 	}
-	if startUrl != "" {
+	//其他进程发出的启动命令已由发出命令的进程添加启动url
+	if startUrl != "" && trigger != TriggerWorker {
 		if err := t.queue.AddURL(startUrl); err != nil {
 			Log.Error(fmt.Sprintf("队列任务【%s-%s】添加startUrl失败, err:%s", t.tongs.Name, t.Name, err.Error()))
-			t.Stop()
+			t.failStart(err.Error())
 			return err
 		}
 	}
-	t.Status = Status["running"]
+	//上次运行暂停后停止时清除暂停,需要在变为运行中之前清除,之后的暂停在队列启动前也能生效
+	t.queue.Resume()
+	t.startRun(url, trigger)
+	if err := t.setStatus(StatusRunning, ""); err != nil {
+		t.end(err)
+		return err
+	}
 	Log.Info(fmt.Sprintf("队列任务【%s-%s】启动", t.tongs.Name, t.Name))
 	go func() {
-		if err := t.queue.Run(t.collector); err != nil {
-			Log.Error(fmt.Sprintf("队列任务【%s-%s】启动失败, err:%s", t.tongs.Name, t.Name, err.Error()))
-		}
-		Log.Info(fmt.Sprintf("队列任务【%s-%s】执行完成", t.tongs.Name, t.Name))
-		defer t.Stop()
+		//队列为空且所有进程都没有处理中的请求时结束
+		t.end(t.queue.Run(t.collector))
 	}()
 	return nil
 }
 
-func (t *Task) collectorRun(url string) error {
+func (t *Task) collectorRun(url, trigger string) error {
 	var startUrl string
 	if url != "" {
 		startUrl = url
@@ -275,15 +483,23 @@ func (t *Task) collectorRun(url string) error {
 	}
 	if startUrl == "" {
 		Log.Error(fmt.Sprintf("普通任务【%s-%s】启动失败, err:%s", t.tongs.Name, t.Name, "启动url必填"))
-		t.Stop()
+		t.failStart("启动url必填")
 		return errors.New(fmt.Sprintf("【%s】普通任务启动url必填", t.Name))
 	}
-	t.Status = Status["running"]
+	t.startRun(startUrl, trigger)
+	if err := t.setStatus(StatusRunning, ""); err != nil {
+		t.end(err)
+		return err
+	}
 	Log.Info(fmt.Sprintf("普通任务【%s-%s】启动", t.tongs.Name, t.Name))
 	go func() {
-		if err := t.collector.Visit(startUrl); err != nil {
-			t.Stop()
+		err := t.collector.Visit(startUrl)
+		//异步模式下等待所有请求完成,重试的请求可能再次失败并重试
+		t.collector.Wait()
+		for t.retries.wait() {
+			t.collector.Wait()
 		}
+		t.end(err)
 	}()
 	return nil
 }
@@ -2,15 +2,23 @@ package tong
 
 import (
 	"errors"
+	"fmt"
+	"net/url"
 	"sync"
+	"time"
 
 	"github.com/gocolly/colly/v2"
+	"github.com/gocolly/colly/v2/storage"
 )
 
 type Tongs struct {
 	Name      string
 	Tasks     []*Task //组内任务
 	Ctx       map[string]interface{}
+	KeyPrefix string //redis key前缀 配置文件中的namespaces优先,为空则使用tongs.key-prefix
+	cron      string //代码设置的定时
+	overlap   string //代码设置的定时重叠策略
+	graph     *taskGraph
 	saveFuc   func(map[string]interface{})
 	items     []interface{}
 	itemCount int
@@ -23,7 +31,6 @@ func (t *Tongs) NewTaskWithQueue(name string, options ...colly.CollectorOption)
 	task := &Task{
 		Name:    name,
 		ID:      id,
-		Status:  Status["stop"],
 		IsQueue: true,
 	}
 	task.collector = newCollector(task, options...)
@@ -37,7 +44,6 @@ func (t *Tongs) NewTask(name string, options ...colly.CollectorOption) *Task {
 	task := &Task{
 		Name:    name,
 		ID:      id,
-		Status:  Status["stop"],
 		IsQueue: false,
 	}
 	task.collector = newCollector(task, options...)
@@ -48,23 +54,42 @@ func (t *Tongs) SetSaveFuc(fuc func(map[string]interface{})) {
 	t.saveFuc = fuc
 }
 
-// Run 启动Tongs所有任务
+// SetKeyPrefix 设置redis key前缀,需要在 Manager.Init 之前调用
+func (t *Tongs) SetKeyPrefix(prefix string) *Tongs {
+	t.KeyPrefix = prefix
+	return t
+}
+
+// Run 启动Tongs所有任务,url按任务顺序对应启动url,配置了任务依赖时只启动没有依赖的任务
 func (t *Tongs) Run(url ...string) error {
+	return t.run(TriggerManual, url)
+}
+
+func (t *Tongs) run(trigger string, url []string) error {
 	if len(t.Tasks) == 0 {
 		return errors.New("当前Tongs内没有任务")
 	}
+	if t.graph.enabled() {
+		return t.graph.run(trigger, url)
+	}
 	for i, t := range t.Tasks {
-		if err := t.Run(url[i]); err != nil {
+		u := ""
+		if i < len(url) {
+			u = url[i]
+		}
+		if err := t.run(u, trigger); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-// Stop 停止Tongs所有任务
+// Stop 停止Tongs所有运行中的任务
 func (t *Tongs) Stop() {
 	for i := range t.Tasks {
-		t.Tasks[i].Stop()
+		if t.Tasks[i].active() {
+			t.Tasks[i].Stop()
+		}
 	}
 }
 
@@ -83,8 +108,170 @@ func (t *Tongs) StopTask(taskName string) error {
 	if task, err := t.findTaskWithName(taskName); err != nil {
 		return err
 	} else {
-		task.Stop()
-		return nil
+		return task.Stop()
+	}
+}
+
+// PauseTask 暂停任务
+func (t *Tongs) PauseTask(taskName string) error {
+	if task, err := t.findTaskWithName(taskName); err != nil {
+		return err
+	} else {
+		return task.Pause()
+	}
+}
+
+// ResumeTask 恢复任务
+func (t *Tongs) ResumeTask(taskName string) error {
+	if task, err := t.findTaskWithName(taskName); err != nil {
+		return err
+	} else {
+		return task.Resume()
+	}
+}
+
+// Reset 重置Tongs内所有任务的队列、访问记录或cookie,有任务运行中时不能重置
+func (t *Tongs) Reset(opt ResetOption) error {
+	for _, task := range t.Tasks {
+		if task.active() {
+			return errors.New(fmt.Sprintf("任务【%s】运行中,请先停止任务", task.Name))
+		}
+	}
+	//共用的访问记录和cookie只通过第一个任务重置一次
+	for i, task := range t.Tasks {
+		taskOpt := opt
+		if i > 0 {
+			taskOpt &^= sharedReset()
+		}
+		if taskOpt == 0 {
+			continue
+		}
+		if err := task.reset(taskOpt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ResetTask 重置任务
+func (t *Tongs) ResetTask(taskName string, opt ResetOption) error {
+	if task, err := t.findTaskWithName(taskName); err != nil {
+		return err
+	} else {
+		return task.Reset(opt)
+	}
+}
+
+// QueueStats 获取Tongs内所有队列任务的队列长度
+func (t *Tongs) QueueStats() ([]*QueueStat, error) {
+	stats := make([]*QueueStat, 0, len(t.Tasks))
+	for _, task := range t.Tasks {
+		if !task.IsQueue {
+			continue
+		}
+		stat, err := task.QueueStat()
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+// Identities 获取Tongs内所有账号
+func (t *Tongs) Identities() ([]*Identity, error) {
+	stores, err := t.identityStores()
+	if err != nil {
+		return nil, err
+	}
+	return stores[0].Identities()
+}
+
+// ImportIdentity 导入账号,cookies为 host -> 浏览器中复制的cookie请求头,已存在的账号会被重新启用并覆盖对应host的cookie
+func (t *Tongs) ImportIdentity(name string, cookies map[string]string) error {
+	if name == "" {
+		return errors.New("账号名称不能为空")
+	}
+	stores, err := t.identityStores()
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		for host, header := range cookies {
+			s.SetIdentityCookies(name, &url.URL{Host: host}, storage.StringifyCookies(parseCookieHeader(header)))
+		}
+		if err := s.SaveIdentity(&Identity{Name: name, UpdatedAt: time.Now().Unix()}); err != nil {
+			return err
+		}
+	}
+	t.invalidateIdentities()
+	Log.Info(fmt.Sprintf("【%s】导入账号【%s】", t.Name, name))
+	return nil
+}
+
+// RetireIdentity 停用账号
+func (t *Tongs) RetireIdentity(name, reason string) error {
+	stores, err := t.identityStores()
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		if err := retireIdentity(s, name, reason); err != nil {
+			return err
+		}
+	}
+	t.invalidateIdentities()
+	Log.Info(fmt.Sprintf("【%s】账号【%s】已停用: %s", t.Name, name, reason))
+	return nil
+}
+
+// RemoveIdentity 删除账号及其cookie
+func (t *Tongs) RemoveIdentity(name string) error {
+	stores, err := t.identityStores()
+	if err != nil {
+		return err
+	}
+	for _, s := range stores {
+		if err := s.RemoveIdentity(name); err != nil {
+			return err
+		}
+	}
+	t.invalidateIdentities()
+	Log.Info(fmt.Sprintf("【%s】删除账号【%s】", t.Name, name))
+	return nil
+}
+
+// identityStores Tongs内任务的存储器类型可能不同,账号需要写入每个存储器,保存位置相同的存储器只返回一个
+func (t *Tongs) identityStores() ([]IdentityStore, error) {
+	var stores []IdentityStore
+	seen := make(map[interface{}]bool)
+	for _, task := range t.Tasks {
+		s, ok := task.store.(IdentityStore)
+		if !ok {
+			continue
+		}
+		var backend interface{} = s
+		if b, ok := s.(identityBackend); ok {
+			backend = b.identityBackend()
+		}
+		if seen[backend] {
+			continue
+		}
+		seen[backend] = true
+		stores = append(stores, s)
+	}
+	if len(stores) == 0 {
+		return nil, errors.New(fmt.Sprintf("【%s】没有支持多账号的任务", t.Name))
+	}
+	return stores, nil
+}
+
+// invalidateIdentities 账号变更后通知任务重新加载账号池
+func (t *Tongs) invalidateIdentities() {
+	for _, task := range t.Tasks {
+		if task.identities != nil {
+			task.identities.invalidate()
+		}
 	}
 }
 
@@ -0,0 +1,348 @@
+package tong
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+const (
+	CommandRun    = "run"
+	CommandStop   = "stop"
+	CommandPause  = "pause"
+	CommandResume = "resume"
+)
+
+// Command 启动、停止等命令,开启多进程协作时同步到所有进程执行
+type Command struct {
+	Action string    `json:"action"`
+	Tongs  string    `json:"tongs"`
+	Task   string    `json:"task,omitempty"` //为空则作用于整个Tongs
+	Urls   []string  `json:"urls,omitempty"` //启动url,启动整个Tongs时按任务顺序对应
+	From   string    `json:"from,omitempty"` //发出命令的进程
+	At     time.Time `json:"at"`
+}
+
+// WorkerTask 进程内运行中的任务
+type WorkerTask struct {
+	Tongs    string     `json:"tongs"`
+	Task     string     `json:"task"`
+	Status   TaskStatus `json:"status"`
+	Requests int64      `json:"requests"` //本次运行发出的请求数量
+	Inflight int        `json:"inflight"` //执行中的请求数量
+}
+
+// WorkerLoad 进程负载
+type WorkerLoad struct {
+	Tasks      int `json:"tasks"`      //运行中的任务数量
+	Inflight   int `json:"inflight"`   //执行中的请求数量
+	Goroutines int `json:"goroutines"` //协程数量
+}
+
+// WorkerInfo 进程信息,随心跳写入redis
+type WorkerInfo struct {
+	ID        string        `json:"id"`
+	Host      string        `json:"host"`
+	Pid       int           `json:"pid"`
+	StartedAt time.Time     `json:"startedAt"`
+	Heartbeat time.Time     `json:"heartbeat"`
+	Leader    bool          `json:"leader"` //是否是主进程
+	Tasks     []*WorkerTask `json:"tasks"`
+	Load      WorkerLoad    `json:"load"`
+}
+
+// worker 当前进程在redis中的注册信息
+type worker struct {
+	id        string
+	host      string
+	startedAt time.Time
+	client    redis.UniversalClient
+	interval  time.Duration
+	ttl       time.Duration
+	pubsub    *redis.PubSub
+	elector   *elector
+	stop      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// currentWorker 开启多进程协作时当前进程的注册信息
+var currentWorker *worker
+
+// initWorker 开启多进程协作时注册当前进程,定时上报心跳并接收其他进程发出的命令
+func initWorker() {
+	c := Config.Worker
+	if !c.Open {
+		return
+	}
+	if Redis == nil {
+		panic("开启多进程协作需要配置redis")
+	}
+	host, _ := os.Hostname()
+	w := &worker{
+		id:        c.Name,
+		host:      host,
+		startedAt: time.Now(),
+		client:    Redis,
+		interval:  time.Duration(c.Heartbeat) * time.Second,
+		ttl:       time.Duration(c.Ttl) * time.Second,
+		stop:      make(chan struct{}),
+	}
+	if w.id == "" {
+		w.id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+	if w.interval <= 0 {
+		w.interval = 5 * time.Second
+	}
+	if w.ttl <= 0 {
+		w.ttl = 3 * w.interval
+	}
+	if err := w.heartbeat(); err != nil {
+		panic(fmt.Sprintf("进程【%s】注册失败,error:%s", w.id, err.Error()))
+	}
+	w.pubsub = w.client.Subscribe(commandChannel())
+	if _, err := w.pubsub.Receive(); err != nil {
+		panic(fmt.Sprintf("进程【%s】订阅命令失败,error:%s", w.id, err.Error()))
+	}
+	lease := time.Duration(c.Lease) * time.Second
+	if lease <= 0 {
+		lease = w.ttl
+	}
+	w.elector = newElector(w.id, w.client, lease)
+	w.elector.start()
+	currentWorker = w
+	w.wg.Add(2)
+	go w.heartbeatLoop()
+	go w.receive()
+	Log.Info(fmt.Sprintf("进程【%s】已注册", w.id))
+}
+
+func workerKey(id string) string {
+	return withKeyPrefix("tongs:workers:" + id)
+}
+
+func commandChannel() string {
+	return withKeyPrefix("tongs:commands")
+}
+
+// withKeyPrefix 进程级别的key使用全局key前缀
+func withKeyPrefix(key string) string {
+	if Config.KeyPrefix != "" {
+		return Config.KeyPrefix + ":" + key
+	}
+	return key
+}
+
+func (w *worker) heartbeat() error {
+	b, err := json.Marshal(w.info())
+	if err != nil {
+		return err
+	}
+	return w.client.Set(workerKey(w.id), b, w.ttl).Err()
+}
+
+func (w *worker) heartbeatLoop() {
+	defer w.wg.Done()
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			if err := w.heartbeat(); err != nil {
+				Log.Error(fmt.Sprintf("进程【%s】心跳上报失败, err:%s", w.id, err.Error()))
+			}
+		}
+	}
+}
+
+// receive 执行其他进程发出的命令,自己发出的命令已在本地执行
+func (w *worker) receive() {
+	defer w.wg.Done()
+	for msg := range w.pubsub.Channel() {
+		cmd := &Command{}
+		if err := json.Unmarshal([]byte(msg.Payload), cmd); err != nil {
+			Log.Error(fmt.Sprintf("命令解析失败, err:%s", err.Error()))
+			continue
+		}
+		if cmd.From == w.id {
+			continue
+		}
+		Log.Info(fmt.Sprintf("收到进程【%s】的命令【%s】【%s-%s】", cmd.From, cmd.Action, cmd.Tongs, cmd.Task))
+		if err := execCommand(cmd, TriggerWorker); err != nil {
+			Log.Warn(fmt.Sprintf("进程【%s】的命令【%s】执行失败, err:%s", cmd.From, cmd.Action, err.Error()))
+		}
+	}
+}
+
+func (w *worker) publish(cmd *Command) error {
+	cmd.From = w.id
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return err
+	}
+	return w.client.Publish(commandChannel(), b).Err()
+}
+
+// close 释放主进程租约,停止接收命令和心跳,并从redis中注销
+func (w *worker) close() {
+	w.elector.close()
+	close(w.stop)
+	w.pubsub.Close()
+	w.wg.Wait()
+	if err := w.client.Del(workerKey(w.id)).Err(); err != nil {
+		Log.Error(fmt.Sprintf("进程【%s】注销失败, err:%s", w.id, err.Error()))
+		return
+	}
+	Log.Info(fmt.Sprintf("进程【%s】已注销", w.id))
+}
+
+// info 当前进程的运行中任务和负载
+func (w *worker) info() *WorkerInfo {
+	info := &WorkerInfo{
+		ID:        w.id,
+		Host:      w.host,
+		Pid:       os.Getpid(),
+		StartedAt: w.startedAt,
+		Heartbeat: time.Now(),
+		Leader:    w.elector != nil && w.elector.leader.Load(),
+		Tasks:     make([]*WorkerTask, 0),
+	}
+	for _, t := range managers {
+		for _, task := range t.Tasks {
+			if !task.active() {
+				continue
+			}
+			wt := &WorkerTask{Tongs: t.Name, Task: task.Name, Status: task.State(), Inflight: task.inflight()}
+			if run := task.LastRun(); run != nil {
+				wt.Requests = run.Requests
+			}
+			info.Tasks = append(info.Tasks, wt)
+			info.Load.Inflight += wt.Inflight
+		}
+	}
+	info.Load.Tasks = len(info.Tasks)
+	info.Load.Goroutines = runtime.NumGoroutine()
+	return info
+}
+
+// inflight 执行中的请求数量,普通任务按已发出但还没有响应的请求估算
+func (t *Task) inflight() int {
+	if t.IsQueue {
+		n := 0
+		t.queue.inflight.Range(func(key, value interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	}
+	run := t.LastRun()
+	if run == nil {
+		return 0
+	}
+	if n := run.Requests - run.Responses - run.Errors; n > 0 {
+		return int(n)
+	}
+	return 0
+}
+
+// Exec 在当前进程执行命令,开启多进程协作时同时发送给其他进程,返回当前进程的执行结果
+func (m *Manager) Exec(cmd *Command) error {
+	cmd.At = time.Now()
+	err := execCommand(cmd, TriggerManual)
+	broadcast(cmd)
+	return err
+}
+
+// broadcast 开启多进程协作时将命令发送给其他进程
+func broadcast(cmd *Command) {
+	w := currentWorker
+	if w == nil {
+		return
+	}
+	if err := w.publish(cmd); err != nil {
+		Log.Error(fmt.Sprintf("命令【%s】发送到其他进程失败, err:%s", cmd.Action, err.Error()))
+	}
+}
+
+// execCommand 执行命令,其他进程发出的启动命令由发出命令的进程添加启动url,当前进程只消费共用的队列
+func execCommand(cmd *Command, trigger string) error {
+	tongs, err := findTongs(cmd.Tongs)
+	if err != nil {
+		return err
+	}
+	url := ""
+	if len(cmd.Urls) > 0 {
+		url = cmd.Urls[0]
+	}
+	switch cmd.Action {
+	case CommandRun:
+		if cmd.Task == "" {
+			return tongs.run(trigger, cmd.Urls)
+		}
+		task, err := tongs.findTaskWithName(cmd.Task)
+		if err != nil {
+			return err
+		}
+		return task.run(url, trigger)
+	case CommandStop:
+		if cmd.Task == "" {
+			tongs.Stop()
+			return nil
+		}
+		return tongs.StopTask(cmd.Task)
+	case CommandPause, CommandResume:
+		if cmd.Task == "" {
+			return errors.New(fmt.Sprintf("命令【%s】需要指定任务", cmd.Action))
+		}
+		if cmd.Action == CommandPause {
+			return tongs.PauseTask(cmd.Task)
+		}
+		return tongs.ResumeTask(cmd.Task)
+	}
+	return errors.New(fmt.Sprintf("不支持的命令【%s】", cmd.Action))
+}
+
+// Workers 获取所有在线的进程,超过ttl没有心跳的进程已自动下线
+func (m *Manager) Workers() ([]*WorkerInfo, error) {
+	if Redis == nil {
+		return nil, errors.New("未配置redis")
+	}
+	keys, err := scanKeys(Redis, escapeGlob(workerKey(""))+"*")
+	if err != nil {
+		return nil, err
+	}
+	workers := make([]*WorkerInfo, 0, len(keys))
+	for _, key := range keys {
+		b, err := Redis.Get(key).Bytes()
+		if err == redis.Nil {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		info := &WorkerInfo{}
+		if err := json.Unmarshal(b, info); err != nil {
+			return nil, err
+		}
+		workers = append(workers, info)
+	}
+	sort.Slice(workers, func(i, j int) bool {
+		return workers[i].ID < workers[j].ID
+	})
+	return workers, nil
+}
+
+// WorkerID 当前进程的名称,未开启多进程协作时为空
+func (m *Manager) WorkerID() string {
+	if currentWorker == nil {
+		return ""
+	}
+	return currentWorker.id
+}
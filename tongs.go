@@ -1,19 +1,65 @@
 package tongs
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"tongs/global"
 	"tongs/initialize"
 )
 
 type M map[string]interface{}
 
+// Run 启动接口服务,收到退出信号后先停止所有任务再关闭接口服务
 func Run() {
-	http := initialize.InitRouter()
+	router := initialize.InitRouter()
 	port := global.CONFIG.Server.Port
 	if port == "" {
 		port = "8080"
 	}
-	http.Run(":" + port)
+	srv := &http.Server{Addr: ":" + port, Handler: router}
+	errc := make(chan error, 1)
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errc <- err
+		}
+	}()
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case sig := <-quit:
+		global.Log.Info(fmt.Sprintf("收到信号【%s】,开始关闭", sig.String()))
+	case err := <-errc:
+		global.Log.Error(fmt.Sprintf("接口服务启动失败, err:%s", err.Error()))
+	}
+	signal.Stop(quit)
+	Shutdown(srv)
+}
+
+// Shutdown 停止所有任务,等待执行中的请求完成并保存运行记录后关闭接口服务
+// 关闭期间接口服务仍可以查询任务状态,但不能再启动任务
+func Shutdown(srv *http.Server) {
+	timeout := time.Duration(global.CONFIG.Server.ShutdownTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := global.TongsManager.Shutdown(ctx); err != nil {
+		global.Log.Error(fmt.Sprintf("任务停止失败, err:%s", err.Error()))
+	}
+	httpCtx, httpCancel := context.WithTimeout(context.Background(), timeout)
+	defer httpCancel()
+	if err := srv.Shutdown(httpCtx); err != nil {
+		global.Log.Error(fmt.Sprintf("接口服务关闭失败, err:%s", err.Error()))
+	}
+	global.Log.Info("已关闭")
+	global.Log.Sync()
 }
 
 func Init() {